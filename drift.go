@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"mongo-es/drift"
+	"mongo-es/utils"
+	"sort"
+)
+
+func runDrift(cfg *utils.Conf, args []string) error {
+	fs := flag.NewFlagSet("drift", flag.ExitOnError)
+	accept := fs.Bool("accept", false, "make the observed schema the new baseline")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	drift.Dir = cfg.Drift.GetDir()
+	colls := fs.Args()
+	if len(colls) == 0 {
+		var err error
+		if colls, err = drift.Colls(); err != nil {
+			return err
+		}
+	}
+	if len(colls) == 0 {
+		return fmt.Errorf("no schema observed yet in %s", drift.Dir)
+	}
+	vanishAfter := cfg.Drift.GetVanishAfter()
+
+	if *accept {
+		for _, coll := range colls {
+			if err := drift.Accept(coll, vanishAfter); err != nil {
+				return err
+			}
+			fmt.Printf("accepted the schema of %s\n", coll)
+		}
+		return nil
+	}
+
+	drifted := false
+	for _, coll := range colls {
+		state, accepted, err := drift.Load(coll)
+		if err != nil {
+			return err
+		}
+		changes := drift.Diff(accepted.Source, state.Source, int64(vanishAfter))
+		drifted = printDrift(coll, state.Source.Docs, changes) || drifted
+		indices := make([]string, 0, len(state.Indices))
+		for index := range state.Indices {
+			indices = append(indices, index)
+		}
+		sort.Strings(indices)
+		for _, index := range indices {
+			schema := state.Indices[index]
+			changes := drift.Diff(accepted.Indices[index], schema, int64(vanishAfter))
+			drifted = printDrift(coll+" -> "+index, schema.Docs, changes) || drifted
+		}
+	}
+	if drifted {
+		fmt.Println("update mappings.yaml if needed, then run drift -accept")
+	}
+	return nil
+}
+
+func printDrift(stage string, docs int64, changes []drift.Change) bool {
+	if len(changes) == 0 {
+		fmt.Printf("%s: no drift in %d documents\n", stage, docs)
+		return false
+	}
+	fmt.Printf("%s: %d changes in %d documents\n", stage, len(changes), docs)
+	for _, change := range changes {
+		fmt.Printf("  %s\n", change)
+	}
+	return true
+}
@@ -0,0 +1,529 @@
+// Package drift tracks the fields and types documents actually have, per
+// collection as read from MongoDB and per index as sent to Elasticsearch, and
+// compares them with an accepted baseline.
+package drift
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Dir is where observed schemas and baselines are saved.
+var Dir = "processed/schema"
+
+// saveEvery bounds how often observed schemas are written to disk.
+const saveEvery = 10 * time.Second
+
+type Field struct {
+	Types []string `json:"types"`
+	// LastSeen is the document count of the schema when the field was last seen.
+	LastSeen int64 `json:"last_seen"`
+}
+
+// Schema is the set of fields observed in a stream of documents.
+type Schema struct {
+	Docs   int64             `json:"docs"`
+	Fields map[string]*Field `json:"fields"`
+}
+
+func newSchema() *Schema {
+	return &Schema{Fields: map[string]*Field{}}
+}
+
+// observe records one document, fields holds its paths and their types.
+func (s *Schema) observe(fields map[string]string) {
+	s.Docs++
+	for name, typ := range fields {
+		field, ok := s.Fields[name]
+		if !ok {
+			field = &Field{}
+			s.Fields[name] = field
+		}
+		field.LastSeen = s.Docs
+		if typ != "null" && !slices.Contains(field.Types, typ) {
+			field.Types = append(field.Types, typ)
+			sort.Strings(field.Types)
+		}
+	}
+}
+
+// Baseline is the accepted type list per field.
+type Baseline map[string][]string
+
+func (s *Schema) baseline(vanishAfter int64) Baseline {
+	b := Baseline{}
+	for name, field := range s.Fields {
+		if !s.vanished(field, vanishAfter) {
+			b[name] = slices.Clone(field.Types)
+		}
+	}
+	return b
+}
+
+func (s *Schema) vanished(field *Field, vanishAfter int64) bool {
+	return s.Docs-field.LastSeen >= vanishAfter
+}
+
+// State is everything observed for a collection.
+type State struct {
+	Source  *Schema            `json:"source"`
+	Indices map[string]*Schema `json:"indices"`
+}
+
+// Accepted is the baseline of a collection, what mappings.yaml was last
+// reviewed against.
+type Accepted struct {
+	Source  Baseline            `json:"source"`
+	Indices map[string]Baseline `json:"indices"`
+}
+
+const (
+	KindNew      = "new"
+	KindType     = "type"
+	KindVanished = "vanished"
+)
+
+// Change is a difference between a baseline and an observed schema.
+type Change struct {
+	Field string
+	Kind  string
+	Types []string
+	Was   []string
+}
+
+func (c Change) String() string {
+	switch c.Kind {
+	case KindNew:
+		return fmt.Sprintf("new field %s (%s)", c.Field, strings.Join(c.Types, ", "))
+	case KindType:
+		return fmt.Sprintf("field %s is %s, was %s", c.Field, strings.Join(c.Types, ", "), strings.Join(c.Was, ", "))
+	}
+	return fmt.Sprintf("field %s vanished (%s)", c.Field, strings.Join(c.Was, ", "))
+}
+
+// Diff compares an observed schema with its baseline, fields not seen in the
+// last vanishAfter documents are reported as vanished.
+func Diff(baseline Baseline, schema *Schema, vanishAfter int64) []Change {
+	changes := []Change{}
+	for name, field := range schema.Fields {
+		was, known := baseline[name]
+		switch {
+		case !known:
+			if !schema.vanished(field, vanishAfter) {
+				changes = append(changes, Change{Field: name, Kind: KindNew, Types: field.Types})
+			}
+		case slices.ContainsFunc(field.Types, func(typ string) bool { return !slices.Contains(was, typ) }):
+			changes = append(changes, Change{Field: name, Kind: KindType, Types: field.Types, Was: was})
+		}
+	}
+	for name, was := range baseline {
+		field, ok := schema.Fields[name]
+		if !ok && schema.Docs >= vanishAfter || ok && schema.vanished(field, vanishAfter) {
+			changes = append(changes, Change{Field: name, Kind: KindVanished, Was: was})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// Tracker observes documents while syncing and logs drift as it appears.
+type Tracker struct {
+	vanishAfter int64
+	mu          sync.Mutex
+	colls       map[string]*collState
+}
+
+type collState struct {
+	state    State
+	accepted Accepted
+	seeded   bool
+	reported map[string]bool
+	saved    time.Time
+}
+
+func NewTracker(vanishAfter int) *Tracker {
+	return &Tracker{vanishAfter: int64(vanishAfter), colls: map[string]*collState{}}
+}
+
+func (t *Tracker) coll(name string) *collState {
+	if c, ok := t.colls[name]; ok {
+		return c
+	}
+	c := &collState{reported: map[string]bool{}}
+	state, err := loadState(name)
+	if err != nil {
+		slog.Warn("ignoring saved schema", "collection", name, "error", err)
+	}
+	c.state = state
+	accepted, ok, err := loadAccepted(name)
+	if err != nil {
+		slog.Warn("ignoring saved schema baseline", "collection", name, "error", err)
+	}
+	c.accepted, c.seeded = accepted, ok
+	t.colls[name] = c
+	return c
+}
+
+// ObserveSource records documents as read from MongoDB.
+func (t *Tracker) ObserveSource(coll string, raws []bson.Raw) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.coll(coll)
+	for _, raw := range raws {
+		fields := map[string]string{}
+		rawFields("", bsoncore.Document(raw), fields)
+		c.state.Source.observe(fields)
+	}
+	t.check(coll, c)
+}
+
+// ObserveIndex records mapped documents sent to index.
+func (t *Tracker) ObserveIndex(coll, index string, docs []map[string]any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.coll(coll)
+	schema := c.index(index)
+	for _, doc := range docs {
+		fields := map[string]string{}
+		mapFields("", doc, fields)
+		schema.observe(fields)
+	}
+	t.check(coll, c)
+}
+
+// ObserveRenamed records documents sent to index straight from BSON, rename
+// gives the indexed name of a source field or false when it is left out.
+func (t *Tracker) ObserveRenamed(coll, index string, raws []bson.Raw, rename func(string) (string, bool)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.coll(coll)
+	schema := c.index(index)
+	for _, raw := range raws {
+		source := map[string]string{}
+		rawFields("", bsoncore.Document(raw), source)
+		fields := make(map[string]string, len(source))
+		for name, typ := range source {
+			if name, ok := rename(name); ok {
+				fields[name] = typ
+			}
+		}
+		schema.observe(fields)
+	}
+	t.check(coll, c)
+}
+
+func (c *collState) index(name string) *Schema {
+	schema, ok := c.state.Indices[name]
+	if !ok {
+		schema = newSchema()
+		c.state.Indices[name] = schema
+	}
+	return schema
+}
+
+// check logs changes not reported yet and saves the schema now and then. A
+// collection without a baseline accepts what it saw first.
+func (t *Tracker) check(coll string, c *collState) {
+	if !c.seeded {
+		c.accepted = accept(c.state, t.vanishAfter)
+		c.seeded = true
+		if err := saveAccepted(coll, c.accepted); err != nil {
+			slog.Error("failed to save schema baseline", "collection", coll, "error", err)
+		}
+	}
+	for index := range c.state.Indices {
+		if _, ok := c.accepted.Indices[index]; !ok {
+			c.accepted.Indices[index] = c.state.Indices[index].baseline(t.vanishAfter)
+			if err := saveAccepted(coll, c.accepted); err != nil {
+				slog.Error("failed to save schema baseline", "collection", coll, "error", err)
+			}
+		}
+	}
+	t.report(c, c.accepted.Source, c.state.Source, "collection", coll)
+	for index, schema := range c.state.Indices {
+		t.report(c, c.accepted.Indices[index], schema, "collection", coll, "index", index)
+	}
+	if time.Since(c.saved) < saveEvery {
+		return
+	}
+	c.saved = time.Now()
+	if err := saveState(coll, c.state); err != nil {
+		slog.Error("failed to save schema", "collection", coll, "error", err)
+	}
+	// pick up baselines accepted while syncing
+	if accepted, ok, err := loadAccepted(coll); err == nil && ok {
+		c.accepted = accepted
+	}
+}
+
+func (t *Tracker) report(c *collState, baseline Baseline, schema *Schema, stage ...any) {
+	for _, change := range Diff(baseline, schema, t.vanishAfter) {
+		key := fmt.Sprint(stage...) + "\x00" + change.String()
+		if c.reported[key] {
+			continue
+		}
+		c.reported[key] = true
+		slog.Warn("schema drift", append(stage, "field", change.Field, "change", change.String())...)
+	}
+}
+
+// Flush writes every observed schema to disk.
+func (t *Tracker) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, c := range t.colls {
+		if err := saveState(name, c.state); err != nil {
+			return err
+		}
+		c.saved = time.Now()
+	}
+	return nil
+}
+
+func accept(state State, vanishAfter int64) Accepted {
+	accepted := Accepted{Source: state.Source.baseline(vanishAfter), Indices: map[string]Baseline{}}
+	for index, schema := range state.Indices {
+		accepted.Indices[index] = schema.baseline(vanishAfter)
+	}
+	return accepted
+}
+
+// Accept makes the observed schema of coll its new baseline.
+func Accept(coll string, vanishAfter int) error {
+	state, err := loadState(coll)
+	if err != nil {
+		return err
+	}
+	return saveAccepted(coll, accept(state, int64(vanishAfter)))
+}
+
+// Colls lists the collections with an observed schema.
+func Colls() ([]string, error) {
+	entries, err := os.ReadDir(Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %s", Dir, err.Error())
+	}
+	colls := []string{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if ok && !strings.HasSuffix(name, ".baseline") {
+			colls = append(colls, name)
+		}
+	}
+	sort.Strings(colls)
+	return colls, nil
+}
+
+// Load returns the observed schema and baseline of coll.
+func Load(coll string) (State, Accepted, error) {
+	state, err := loadState(coll)
+	if err != nil {
+		return state, Accepted{}, err
+	}
+	accepted, _, err := loadAccepted(coll)
+	return state, accepted, err
+}
+
+func loadState(coll string) (State, error) {
+	state := State{Source: newSchema(), Indices: map[string]*Schema{}}
+	if err := readJSON(path.Join(Dir, coll+".json"), &state); err != nil && !os.IsNotExist(err) {
+		return State{Source: newSchema(), Indices: map[string]*Schema{}}, err
+	}
+	if state.Source == nil {
+		state.Source = newSchema()
+	}
+	if state.Indices == nil {
+		state.Indices = map[string]*Schema{}
+	}
+	return state, nil
+}
+
+func loadAccepted(coll string) (Accepted, bool, error) {
+	accepted := Accepted{Source: Baseline{}, Indices: map[string]Baseline{}}
+	err := readJSON(path.Join(Dir, coll+".baseline.json"), &accepted)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return accepted, false, nil
+		}
+		return Accepted{Source: Baseline{}, Indices: map[string]Baseline{}}, false, err
+	}
+	if accepted.Source == nil {
+		accepted.Source = Baseline{}
+	}
+	if accepted.Indices == nil {
+		accepted.Indices = map[string]Baseline{}
+	}
+	return accepted, true, nil
+}
+
+func saveState(coll string, state State) error {
+	return writeJSON(path.Join(Dir, coll+".json"), state)
+}
+
+func saveAccepted(coll string, accepted Accepted) error {
+	return writeJSON(path.Join(Dir, coll+".baseline.json"), accepted)
+}
+
+func readJSON(file string, v any) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	return nil
+}
+
+func writeJSON(file string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	// write then rename so the report never reads a partial file
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %s", file, err.Error())
+	}
+	return os.Rename(tmp, file)
+}
+
+var rawTypes = map[bsontype.Type]string{
+	bsontype.Double:           "double",
+	bsontype.String:           "string",
+	bsontype.EmbeddedDocument: "object",
+	bsontype.Array:            "array",
+	bsontype.Binary:           "binary",
+	bsontype.ObjectID:         "objectId",
+	bsontype.Boolean:          "bool",
+	bsontype.DateTime:         "date",
+	bsontype.Null:             "null",
+	bsontype.Regex:            "regex",
+	bsontype.Int32:            "int",
+	bsontype.Timestamp:        "timestamp",
+	bsontype.Int64:            "long",
+	bsontype.Decimal128:       "decimal",
+}
+
+// rawFields collects the dotted paths of a BSON document with their types,
+// documents inside arrays add their fields under the array path.
+func rawFields(prefix string, doc bsoncore.Document, fields map[string]string) {
+	elems, err := doc.Elements()
+	if err != nil {
+		return
+	}
+	for _, elem := range elems {
+		name := elem.Key()
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		value := elem.Value()
+		switch value.Type {
+		case bsontype.EmbeddedDocument:
+			rawFields(name, value.Document(), fields)
+			continue
+		case bsontype.Array:
+			values, err := value.Array().Values()
+			if err != nil {
+				continue
+			}
+			for _, item := range values {
+				if item.Type == bsontype.EmbeddedDocument {
+					rawFields(name, item.Document(), fields)
+				}
+			}
+		}
+		typ, ok := rawTypes[value.Type]
+		if !ok {
+			typ = value.Type.String()
+		}
+		fields[name] = typ
+	}
+}
+
+// mapFields is rawFields for decoded documents, using the same type names.
+func mapFields(prefix string, doc map[string]any, fields map[string]string) {
+	for key, value := range doc {
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case map[string]any:
+			mapFields(name, v, fields)
+			continue
+		case bson.D:
+			mapFields(name, v.Map(), fields)
+			continue
+		case bson.M:
+			mapFields(name, v, fields)
+			continue
+		case []any:
+			arrayFields(name, v, fields)
+		case bson.A:
+			arrayFields(name, v, fields)
+		}
+		fields[name] = valueType(value)
+	}
+}
+
+func arrayFields(name string, items []any, fields map[string]string) {
+	for _, item := range items {
+		if doc, ok := item.(map[string]any); ok {
+			mapFields(name, doc, fields)
+		}
+	}
+}
+
+func valueType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case int32:
+		return "int"
+	case int, int64:
+		return "long"
+	case float32, float64:
+		return "double"
+	case primitive.DateTime, time.Time:
+		return "date"
+	case primitive.ObjectID:
+		return "objectId"
+	case primitive.Decimal128:
+		return "decimal"
+	case primitive.Binary:
+		return "binary"
+	case primitive.Timestamp:
+		return "timestamp"
+	case primitive.Regex:
+		return "regex"
+	case []any, bson.A, []string:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,113 @@
+package drift
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+func marshal(t *testing.T, doc bson.D) bson.Raw {
+	t.Helper()
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestFieldTypes(t *testing.T) {
+	doc := bson.D{
+		{Key: "_id", Value: primitive.NewObjectID()},
+		{Key: "name", Value: "a"},
+		{Key: "age", Value: int32(3)},
+		{Key: "score", Value: 1.5},
+		{Key: "at", Value: primitive.NewDateTimeFromTime(time.Now())},
+		{Key: "gone", Value: nil},
+		{Key: "profile", Value: bson.D{{Key: "city", Value: "x"}}},
+		{Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "s"}}}},
+	}
+	raw := map[string]string{}
+	rawFields("", bsoncore.Document(marshal(t, doc)), raw)
+	want := map[string]string{
+		"_id": "objectId", "name": "string", "age": "int", "score": "double", "at": "date",
+		"gone": "null", "profile.city": "string", "items": "array", "items.sku": "string",
+	}
+	if !reflect.DeepEqual(raw, want) {
+		t.Fatalf("raw:\n got %v\nwant %v", raw, want)
+	}
+	var decoded map[string]any
+	if err := bson.Unmarshal(marshal(t, doc), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	mapped := map[string]string{}
+	mapFields("", decoded, mapped)
+	if !reflect.DeepEqual(mapped, want) {
+		t.Fatalf("mapped:\n got %v\nwant %v", mapped, want)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	schema := newSchema()
+	schema.observe(map[string]string{"a": "string", "b": "int", "c": "string"})
+	schema.observe(map[string]string{"a": "string", "b": "long", "d": "bool"})
+	schema.observe(map[string]string{"a": "null", "b": "int", "d": "bool"})
+	baseline := Baseline{"a": {"string"}, "b": {"int"}, "c": {"string"}, "e": {"string"}}
+
+	got := Diff(baseline, schema, 2)
+	want := []Change{
+		{Field: "b", Kind: KindType, Types: []string{"int", "long"}, Was: []string{"int"}},
+		{Field: "c", Kind: KindVanished, Was: []string{"string"}},
+		{Field: "d", Kind: KindNew, Types: []string{"bool"}},
+		{Field: "e", Kind: KindVanished, Was: []string{"string"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	if got := Diff(schema.baseline(2), schema, 2); len(got) != 0 {
+		t.Fatalf("expected no drift against its own baseline, got %v", got)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	Dir = t.TempDir()
+	tracker := NewTracker(1000)
+	tracker.ObserveSource("users", []bson.Raw{marshal(t, bson.D{{Key: "name", Value: "a"}})})
+	tracker.ObserveIndex("users", "user_index", []map[string]any{{"full_name": "a"}})
+	tracker.ObserveSource("users", []bson.Raw{marshal(t, bson.D{{Key: "name", Value: int32(1)}, {Key: "email", Value: "e"}})})
+	tracker.ObserveRenamed("users", "user_index", []bson.Raw{marshal(t, bson.D{{Key: "name", Value: "b"}, {Key: "email", Value: "e"}})},
+		func(field string) (string, bool) { return "full_name", field == "name" })
+	if err := tracker.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	colls, err := Colls()
+	if err != nil || !reflect.DeepEqual(colls, []string{"users"}) {
+		t.Fatalf("got colls %v err %v", colls, err)
+	}
+	state, accepted, err := Load("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(accepted.Source, Baseline{"name": {"string"}}) {
+		t.Fatalf("first batch should seed the baseline, got %v", accepted.Source)
+	}
+	changes := Diff(accepted.Source, state.Source, 1000)
+	if len(changes) != 2 || changes[0].Field != "email" || changes[1].Kind != KindType {
+		t.Fatalf("unexpected source drift %v", changes)
+	}
+	if changes := Diff(accepted.Indices["user_index"], state.Indices["user_index"], 1000); len(changes) != 0 {
+		t.Fatalf("unexpected index drift %v", changes)
+	}
+
+	if err := Accept("users", 1000); err != nil {
+		t.Fatal(err)
+	}
+	state, accepted, _ = Load("users")
+	if changes := Diff(accepted.Source, state.Source, 1000); len(changes) != 0 {
+		t.Fatalf("expected no drift after accept, got %v", changes)
+	}
+}
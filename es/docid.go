@@ -0,0 +1,78 @@
+package es
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mongo-es/utils"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	missingError = "error"
+	missingSkip  = "skip"
+	missingAuto  = "auto"
+)
+
+func validateDocID(prefix string, cfg utils.DocIDConf) error {
+	switch cfg.Hash {
+	case "none", "sha1", "sha256", "auto":
+	default:
+		return fmt.Errorf("unknown doc_id hash %q for %s", cfg.Hash, prefix)
+	}
+	switch cfg.Missing {
+	case missingError, missingSkip, missingAuto:
+	default:
+		return fmt.Errorf("unknown doc_id missing policy %q for %s", cfg.Missing, prefix)
+	}
+	return nil
+}
+
+// docID builds the document _id from the configured fields, reporting false
+// when any of them is missing from the document.
+func docID(doc map[string]any, cfg utils.DocIDConf) (string, bool, error) {
+	parts := make([]string, 0, len(cfg.Fields))
+	for _, field := range cfg.Fields {
+		value, ok := utils.Lookup(doc, field)
+		if !ok || value == nil {
+			return "", false, nil
+		}
+		parts = append(parts, idString(value))
+	}
+	id := strings.Join(parts, cfg.Separator)
+	switch cfg.Hash {
+	case "sha1":
+		sum := sha1.Sum([]byte(id))
+		return hex.EncodeToString(sum[:]), true, nil
+	case "sha256":
+		sum := sha256.Sum256([]byte(id))
+		return hex.EncodeToString(sum[:]), true, nil
+	case "auto":
+		if len(id) > cfg.MaxLen {
+			sum := sha256.Sum256([]byte(id))
+			return hex.EncodeToString(sum[:]), true, nil
+		}
+	}
+	if len(id) > cfg.MaxLen {
+		return "", true, fmt.Errorf("document id %q is longer than %d bytes", id, cfg.MaxLen)
+	}
+	return id, true, nil
+}
+
+func idString(value any) string {
+	switch v := value.(type) {
+	case primitive.ObjectID:
+		return v.Hex()
+	case string:
+		return v
+	case primitive.DateTime:
+		return strconv.FormatInt(int64(v), 10)
+	case primitive.Binary:
+		return hex.EncodeToString(v.Data)
+	}
+	return fmt.Sprint(value)
+}
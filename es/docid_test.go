@@ -0,0 +1,86 @@
+package es
+
+import (
+	"mongo-es/utils"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDocID(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
+	base := (&utils.ElasticConf{}).GetDocID("orders")
+
+	t.Run("object id rendered as hex", func(t *testing.T) {
+		id, ok, err := docID(map[string]any{"_id": oid}, base)
+		if err != nil || !ok {
+			t.Fatalf("unexpected ok=%v err=%v", ok, err)
+		}
+		if id != "507f1f77bcf86cd799439011" {
+			t.Fatalf("got %s", id)
+		}
+	})
+
+	t.Run("composite key", func(t *testing.T) {
+		cfg := base
+		cfg.Fields = []string{"tenant", "order_no"}
+		id, ok, err := docID(map[string]any{"tenant": "acme", "order_no": int32(42)}, cfg)
+		if err != nil || !ok {
+			t.Fatalf("unexpected ok=%v err=%v", ok, err)
+		}
+		if id != "acme:42" {
+			t.Fatalf("got %s", id)
+		}
+	})
+
+	t.Run("missing field", func(t *testing.T) {
+		cfg := base
+		cfg.Fields = []string{"tenant", "order_no"}
+		if _, ok, err := docID(map[string]any{"tenant": "acme"}, cfg); ok || err != nil {
+			t.Fatalf("expected missing key, got ok=%v err=%v", ok, err)
+		}
+	})
+
+	t.Run("hashing", func(t *testing.T) {
+		cfg := base
+		cfg.Hash = "sha1"
+		id, _, _ := docID(map[string]any{"_id": "a"}, cfg)
+		if id != "86f7e437faa5a7fce15d1ddcb9eaeaea377667b8" {
+			t.Fatalf("got %s", id)
+		}
+	})
+
+	t.Run("auto hash only long keys", func(t *testing.T) {
+		cfg := base
+		cfg.Hash = "auto"
+		cfg.MaxLen = 8
+		id, _, _ := docID(map[string]any{"_id": "short"}, cfg)
+		if id != "short" {
+			t.Fatalf("got %s", id)
+		}
+		id, _, _ = docID(map[string]any{"_id": strings.Repeat("x", 9)}, cfg)
+		if len(id) != 64 {
+			t.Fatalf("expected sha256 hex, got %s", id)
+		}
+	})
+
+	t.Run("too long without hashing", func(t *testing.T) {
+		cfg := base
+		cfg.MaxLen = 4
+		if _, _, err := docID(map[string]any{"_id": "too long"}, cfg); err == nil {
+			t.Fatal("expected error for long id")
+		}
+	})
+}
+
+func TestValidateDocID(t *testing.T) {
+	cfg := (&utils.ElasticConf{}).GetDocID("orders")
+	if err := validateDocID("orders", cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Missing = "ignore"
+	if err := validateDocID("orders", cfg); err == nil {
+		t.Fatal("expected error for unknown missing policy")
+	}
+}
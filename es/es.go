@@ -5,24 +5,73 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"iter"
+	"log/slog"
+	"mongo-es/metrics"
 	"mongo-es/utils"
 	"net/http"
+	"os"
+	"path"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	elastic "github.com/elastic/go-elasticsearch/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("mongo-es/es")
+
+// bulkAction is the action line of a bulk document, create never replaces a
+// document already indexed.
+type bulkAction struct {
+	Index  *bulkMeta `json:"index,omitempty"`
+	Create *bulkMeta `json:"create,omitempty"`
+}
+type bulkMeta struct {
+	Index       string `json:"_index"`
+	ID          string `json:"_id,omitempty"`
+	Routing     string `json:"routing,omitempty"`
+	Version     *int64 `json:"version,omitempty"`
+	VersionType string `json:"version_type,omitempty"`
+}
+type bulkResponse struct {
+	Errors bool                  `json:"errors"`
+	Items  []map[string]bulkItem `json:"items"`
+}
+type bulkItem struct {
+	Index  string         `json:"_index"`
+	ID     string         `json:"_id"`
+	Status int            `json:"status"`
+	Error  *bulkItemError `json:"error"`
+}
+type bulkItemError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
 type EsClient struct {
-	client *elastic.Client
-	cfg    *utils.Conf
+	client  *elastic.Client
+	cfg     *utils.Conf
+	namers  map[string]*indexNamer
+	routers map[string]*router
+	encoder *utils.Encoder
+	mu      sync.Mutex
 }
 
 func NewEsClient(cfg *utils.Conf) *EsClient {
 	return &EsClient{
-		cfg: cfg,
+		cfg:     cfg,
+		namers:  make(map[string]*indexNamer),
+		routers: make(map[string]*router),
+		encoder: utils.NewEncoder(cfg.Elastic.Encoding),
+		mu:      sync.Mutex{},
 	}
 }
 
@@ -37,69 +86,530 @@ func (es *EsClient) Init() error {
 				InsecureSkipVerify: true,
 			},
 		},
+		RetryBackoff: func(attempt int) time.Duration {
+			metrics.Retries.Inc()
+			return 0
+		},
 	}
 	client, err := elastic.NewClient(cfg)
 	if err != nil {
 		return fmt.Errorf("failed to create elastic client: %s", err.Error())
 	}
 	es.client = client
+	if err := es.cfg.Elastic.Encoding.Validate(); err != nil {
+		return err
+	}
+	for prefix := range es.cfg.Elastic.IndexNaming {
+		if _, err := es.namer(prefix); err != nil {
+			return err
+		}
+	}
+	for prefix := range es.cfg.Elastic.Join {
+		join, _ := es.cfg.Elastic.GetJoin(prefix)
+		if err := validateJoin(prefix, join); err != nil {
+			return err
+		}
+	}
+	for prefix := range es.cfg.Elastic.Versioning {
+		versioning, _ := es.cfg.Elastic.GetVersioning(prefix)
+		if err := validateVersioning(prefix, versioning); err != nil {
+			return err
+		}
+	}
+	for prefix := range es.cfg.Elastic.Routes {
+		if _, err := es.router(prefix); err != nil {
+			return err
+		}
+	}
+	for prefix := range es.cfg.Elastic.DocIDs {
+		if err := validateDocID(prefix, es.cfg.Elastic.GetDocID(prefix)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// Ping checks that the cluster answers.
+func (es *EsClient) Ping(ctx context.Context) error {
+	if es.client == nil {
+		return fmt.Errorf("elastic client not initialized")
+	}
+	res, err := es.client.Ping(es.client.Ping.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("elastic ping failed: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("elastic ping failed: %s", res.Status())
+	}
+	return nil
+}
+
+func (es *EsClient) namer(prefix string) (*indexNamer, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if n, ok := es.namers[prefix]; ok {
+		return n, nil
+	}
+	naming := es.cfg.Elastic.GetIndexNaming(prefix)
+	if rc, ok := es.cfg.Elastic.GetRollover(prefix); ok {
+		// rollover indices are written through their alias
+		naming = utils.IndexNamingConf{Strategy: "fixed", Pattern: rc.Alias}
+	} else if alias, ok := es.cfg.Elastic.GetReadAlias(prefix); ok {
+		// the read alias points at a single index, so it accepts writes too
+		naming = utils.IndexNamingConf{Strategy: "fixed", Pattern: alias}
+	}
+	n, err := newIndexNamer(prefix, naming, es.cfg.Elastic.GetIndicPeriod(prefix))
+	if err != nil {
+		return nil, err
+	}
+	es.namers[prefix] = n
+	return n, nil
+}
+
+// router returns the content routes of prefix, without routes every document
+// goes to prefix itself.
+func (es *EsClient) router(prefix string) (*router, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if r, ok := es.routers[prefix]; ok {
+		return r, nil
+	}
+	routes, ok := es.cfg.Elastic.GetRoutes(prefix)
+	if !ok {
+		routes.Default = prefix
+	}
+	r, err := newRouter(prefix, routes)
+	if err != nil {
+		return nil, err
+	}
+	es.routers[prefix] = r
+	return r, nil
+}
+func (es *EsClient) PutTemplates(ctx context.Context) error {
+	dir := es.cfg.Elastic.TemplatesDir
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read templates dir %s: %s", dir, err.Error())
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read template %s: %s", entry.Name(), err.Error())
+		}
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		var template map[string]any
+		if err := json.Unmarshal(data, &template); err != nil {
+			return fmt.Errorf("failed to parse template %s: %w", entry.Name(), err)
+		}
+		if rc, ok := es.cfg.Elastic.GetRollover(name); ok {
+			template = rolloverTemplate(rc, template)
+		}
+		if err := es.putTemplate(ctx, name, template); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (es *EsClient) putTemplate(ctx context.Context, name string, template map[string]any) error {
+	data, err := json.Marshal(template)
+	if err != nil {
+		return fmt.Errorf("failed to marshal template %s: %w", name, err)
+	}
+	res, err := es.client.Indices.PutIndexTemplate(name, bytes.NewReader(data),
+		es.client.Indices.PutIndexTemplate.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to put template %s: %w", name, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("failed to put template %s: %s", name, res.String())
+	}
+	slog.Info("applied index template", "template", name)
+	return nil
+}
+
+// bulkDoc is one document of a bulk request. fields holds the mapped values
+// ids, routing, versions and index names are read from, body is set when the
+// document was already encoded by the raw path.
+type bulkDoc struct {
+	fields map[string]any
+	body   []byte
+}
+
+func mapDocs(processed []map[string]any) iter.Seq2[bulkDoc, error] {
+	return func(yield func(bulkDoc, error) bool) {
+		for _, doc := range processed {
+			if !yield(bulkDoc{fields: doc}, nil) {
+				return
+			}
+		}
+	}
+}
+
+// resolver returns the indices a document of prefix is written to, none when
+// its route drops it.
+func (es *EsClient) resolver(prefix string) (func(map[string]any) ([]string, error), error) {
+	router, err := es.router(prefix)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	routes := map[string]func(map[string]any) ([]string, error){}
+	return func(doc map[string]any) ([]string, error) {
+		dest := router.route(doc)
+		if dest == dropRoute {
+			return nil, nil
+		}
+		indicesFor, ok := routes[dest]
+		if !ok {
+			if indicesFor, err = es.indexer(dest, now); err != nil {
+				return nil, err
+			}
+			routes[dest] = indicesFor
+		}
+		return indicesFor(doc)
+	}, nil
+}
+
+// indexer names the indices of prefix, including the new index of a running
+// reindex.
+func (es *EsClient) indexer(prefix string, now time.Time) (func(map[string]any) ([]string, error), error) {
+	namer, err := es.namer(prefix)
+	if err != nil {
+		return nil, err
+	}
+	dualIndex, dual, err := es.DualWriteIndex(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return func(doc map[string]any) ([]string, error) {
+		index, err := namer.Name(doc, now)
+		if err != nil {
+			return nil, err
+		}
+		if dual {
+			return []string{index, dualIndex}, nil
+		}
+		return []string{index}, nil
+	}, nil
+}
+
+// Target is one index fed from a batch, with either mapped documents or raw
+// documents and the plan mapping them.
+type Target struct {
+	Prefix string
+	Docs   []map[string]any
+	Raws   []bson.Raw
+	Plan   *utils.RawPlan
+}
+
 func (es *EsClient) IndexProcessed(ctx context.Context, processed []map[string]any, prefix string) error {
-	period := es.cfg.Elastic.GetIndicPeriod(prefix)
-	index := fmt.Sprintf("%s-%s", prefix, time.Now().Add(time.Duration(time.Hour*time.Duration(period))).Format(time.DateOnly))
+	return es.IndexTargets(ctx, []Target{{Prefix: prefix, Docs: processed}})
+}
 
-	uniqueField := es.cfg.Elastic.GetUniqueField(prefix)
+// IndexRaw indexes documents mapped by plan without decoding them into maps,
+// documents the plan cannot handle are mapped through its fallback.
+func (es *EsClient) IndexRaw(ctx context.Context, raws []bson.Raw, prefix string, plan *utils.RawPlan) error {
+	return es.IndexTargets(ctx, []Target{{Prefix: prefix, Raws: raws, Plan: plan}})
+}
 
+// IndexTargets sends the documents of every target in a single bulk request.
+func (es *EsClient) IndexTargets(ctx context.Context, targets []Target) error {
 	var buf bytes.Buffer
-	for _, doc := range processed {
-		idVal, ok := doc[uniqueField]
-		if !ok {
-			return fmt.Errorf("document missing unique field %q", uniqueField)
+	indices := newBulkIndices()
+	for _, target := range targets {
+		indicesFor, err := es.resolver(target.Prefix)
+		if err != nil {
+			return err
+		}
+		docs, count := mapDocs(target.Docs), len(target.Docs)
+		if target.Plan != nil {
+			docs, count = es.rawDocs(target.Raws, target.Prefix, target.Plan), len(target.Raws)
+		}
+		// raw targets are mapped while encoded
+		_, span := tracer.Start(ctx, "elastic.encode", trace.WithAttributes(attribute.String("collection", collectionFromContext(ctx)),
+			attribute.String("index", target.Prefix), attribute.Int("docs", count), attribute.Bool("raw", target.Plan != nil)))
+		err = es.appendBulk(ctx, &buf, indices, docs, target.Prefix, indicesFor, false)
+		utils.EndSpan(span, err)
+		if err != nil {
+			return err
+		}
+	}
+	return es.sendBulk(ctx, &buf, indices)
+}
+
+// IndexInto backfills index with the documents of prefix its routes send to
+// prefix itself, documents routed elsewhere or dropped are skipped. Live
+// changes dual-written to index meanwhile are never replaced by the backfill.
+func (es *EsClient) IndexInto(ctx context.Context, processed []map[string]any, prefix, index string) error {
+	indicesFor, err := es.backfiller(prefix, index)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	indices := newBulkIndices()
+	if err := es.appendBulk(ctx, &buf, indices, mapDocs(processed), prefix, indicesFor, true); err != nil {
+		return err
+	}
+	return es.sendBulk(ctx, &buf, indices)
+}
+
+// CanIndexRaw reports whether documents of prefix can be indexed straight
+// from bson.Raw, join fields have to be added to the mapped document.
+func (es *EsClient) CanIndexRaw(prefix string) bool {
+	_, hasJoin := es.cfg.Elastic.GetJoin(prefix)
+	return !hasJoin
+}
+
+func (es *EsClient) rawDocs(raws []bson.Raw, prefix string, plan *utils.RawPlan) iter.Seq2[bulkDoc, error] {
+	want := es.metaFields(prefix)
+	return func(yield func(bulkDoc, error) bool) {
+		var scratch []byte
+		for _, raw := range raws {
+			body, fields, err := plan.AppendJSON(scratch[:0], raw, es.encoder, want)
+			if errors.Is(err, utils.ErrRawFallback) {
+				doc, err := plan.Fallback(raw)
+				if !yield(bulkDoc{fields: doc}, err) {
+					return
+				}
+				continue
+			}
+			if err != nil {
+				yield(bulkDoc{}, err)
+				return
+			}
+			scratch = body
+			if !yield(bulkDoc{fields: fields, body: body}, nil) {
+				return
+			}
 		}
+	}
+}
+
+// metaFields lists the document fields bulk actions and index names read.
+func (es *EsClient) metaFields(prefix string) []string {
+	fields := slices.Clone(es.cfg.Elastic.GetDocID(prefix).Fields)
+	if field := es.cfg.Elastic.GetRouting(prefix); field != "" {
+		fields = append(fields, field)
+	}
+	if versioning, ok := es.cfg.Elastic.GetVersioning(prefix); ok && versioning.Source != "cluster_time" {
+		fields = append(fields, versioning.Field)
+	}
+	router, err := es.router(prefix)
+	if err != nil {
+		return fields
+	}
+	fields = append(fields, router.fields()...)
+	for _, dest := range router.destinations() {
+		if namer, err := es.namer(dest); err == nil && namer.timeField != "" {
+			fields = append(fields, namer.timeField)
+		}
+	}
+	return fields
+}
 
-		delete(doc, "_id")
-		meta := fmt.Appendf(nil,
-			`{ "index" : { "_index" : "%s", "_id" : "%s" } }%s`,
-			index, idVal, "\n",
-		)
-		data, err := json.Marshal(doc)
+// appendBulk writes the actions of docs to buf, counting documents per index.
+// With create, documents are only added to their index, unless versioning
+// already rejects stale writes: create does not take external versions.
+func (es *EsClient) appendBulk(ctx context.Context, buf *bytes.Buffer, indices *bulkIndices, docs iter.Seq2[bulkDoc, error], prefix string, indicesFor func(map[string]any) ([]string, error), create bool) error {
+	idConf := es.cfg.Elastic.GetDocID(prefix)
+	routingField := es.cfg.Elastic.GetRouting(prefix)
+	join, hasJoin := es.cfg.Elastic.GetJoin(prefix)
+	versioning, hasVersioning := es.cfg.Elastic.GetVersioning(prefix)
+	clusterTime := clusterTimeFromContext(ctx)
+	dropped := 0
+
+	for item, err := range docs {
+		if err != nil {
+			return err
+		}
+		doc := item.fields
+		targets, err := indicesFor(doc)
+		if err != nil {
+			return err
+		}
+		if len(targets) == 0 {
+			dropped++
+			continue
+		}
+		id, ok, err := docID(doc, idConf)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			switch idConf.Missing {
+			case missingSkip:
+				slog.Warn("skipping doc missing id fields", "index", prefix, "fields", idConf.Fields)
+				continue
+			case missingError:
+				return fmt.Errorf("document missing id fields %v", idConf.Fields)
+			}
+		}
+		parent := ""
+		if hasJoin {
+			if parent, err = applyJoin(doc, join); err != nil {
+				return err
+			}
+		}
+		routing, err := docRouting(doc, routingField, parent)
 		if err != nil {
-			return fmt.Errorf("failed to marshal json: %w", err)
+			return err
+		}
+		action := bulkMeta{ID: id, Routing: routing}
+		if hasVersioning {
+			version, err := docVersion(doc, versioning, clusterTime)
+			if err != nil {
+				return err
+			}
+			action.Version = &version
+			action.VersionType = versioning.Type
 		}
-		data = append(data, '\n')
 
-		buf.Grow(len(meta) + len(data))
-		buf.Write(meta)
-		buf.Write(data)
+		data := item.body
+		if data == nil {
+			delete(doc, "_id")
+			if data, err = json.Marshal(es.encoder.EncodeDoc(doc)); err != nil {
+				return fmt.Errorf("failed to marshal json: %w", err)
+			}
+		}
+
+		for _, index := range targets {
+			indices.add(index)
+			action.Index = index
+			line := bulkAction{Index: &action}
+			if create && !hasVersioning {
+				line = bulkAction{Create: &action}
+			}
+			meta, err := json.Marshal(line)
+			if err != nil {
+				return fmt.Errorf("failed to marshal bulk action: %w", err)
+			}
+			buf.Grow(len(meta) + len(data) + 2)
+			buf.Write(meta)
+			buf.WriteByte('\n')
+			buf.Write(data)
+			buf.WriteByte('\n')
+		}
+	}
+	if dropped > 0 {
+		slog.Info("dropped docs by route", "collection", collectionFromContext(ctx), "prefix", prefix, "docs", dropped)
 	}
+	return nil
+}
+func (es *EsClient) sendBulk(ctx context.Context, buf *bytes.Buffer, indices *bulkIndices) error {
+	if buf.Len() == 0 {
+		return nil
+	}
+	coll := collectionFromContext(ctx)
+	ctx, span := tracer.Start(ctx, "elastic.bulk", trace.WithAttributes(attribute.String("collection", coll),
+		attribute.Int("docs", indices.docs()), attribute.Int("bytes", buf.Len())))
+	indexed, failed, err := es.bulk(ctx, buf, indices)
+	span.SetAttributes(attribute.Int("indexed", indexed), attribute.Int("failed", failed))
+	utils.EndSpan(span, err)
+	return err
+}
+
+func (es *EsClient) bulk(ctx context.Context, buf *bytes.Buffer, indices *bulkIndices) (int, int, error) {
+	coll := collectionFromContext(ctx)
+	metrics.BulkBytes.WithLabelValues(coll).Observe(float64(buf.Len()))
+	start := time.Now()
 	res, err := es.client.Bulk(
-		strings.NewReader(buf.String()),
+		bytes.NewReader(buf.Bytes()),
 		es.client.Bulk.WithContext(ctx),
 	)
-	var bulkRes map[string]any
+	took := time.Since(start)
+	metrics.BulkDuration.WithLabelValues(coll).Observe(took.Seconds())
+	if err != nil {
+		metrics.DocsFailed.WithLabelValues(coll).Add(float64(indices.docs()))
+		return 0, indices.docs(), fmt.Errorf("bulk request failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		metrics.DocsFailed.WithLabelValues(coll).Add(float64(indices.docs()))
+		return 0, indices.docs(), fmt.Errorf("bulk indexing error: %s", res.String())
+	}
+	var bulkRes bulkResponse
 	if err := json.NewDecoder(res.Body).Decode(&bulkRes); err != nil {
-		return fmt.Errorf("decode bulk response: %w", err)
-	}
-	if bulkRes["errors"] != nil {
-		if bulkRes["errors"].(bool) {
-			for _, item := range bulkRes["items"].([]any) {
-				it := item.(map[string]any)
-				idx := it["index"].(map[string]any)
-				if idx["error"] != nil {
-					return fmt.Errorf("failed doc %v: %+v\n", idx["_id"], idx["error"])
-				}
+		return 0, 0, fmt.Errorf("decode bulk response: %w", err)
+	}
+	indexed, failed, err := bulkResults(bulkRes, indices)
+	metrics.DocsIndexed.WithLabelValues(coll).Add(float64(indexed))
+	metrics.DocsFailed.WithLabelValues(coll).Add(float64(failed))
+	if err != nil {
+		return indexed, failed, err
+	}
+	for index, count := range indices.counts {
+		slog.Info("indexed docs", "collection", coll, "index", index, "batch_size", count, "duration", took)
+	}
+	return indexed, failed, nil
+}
+
+// bulkResults counts the indexed and failed items of a bulk response, stale
+// docs skipped by versioning are neither. The first failure is returned.
+func bulkResults(bulkRes bulkResponse, indices *bulkIndices) (int, int, error) {
+	indexed, failed := 0, 0
+	var first error
+	for i, item := range bulkRes.Items {
+		for _, result := range item {
+			if result.Error == nil {
+				indexed++
+				continue
+			}
+			if result.Status == http.StatusConflict && result.Error.Type == "version_conflict_engine_exception" {
+				// a newer version is already indexed, or a backfill created the
+				// doc after a live write
+				// items come back in action order, result.Index is the concrete
+				// index behind an alias target
+				indices.counts[indices.target(i, result.Index)]--
+				slog.Debug("skipped stale doc", "index", result.Index, "id", result.ID)
+				continue
+			}
+			failed++
+			if first == nil {
+				first = fmt.Errorf("failed doc %s: %s: %s", result.ID, result.Error.Type, result.Error.Reason)
 			}
 		}
 	}
-	if err != nil {
-		return fmt.Errorf("bulk request failed: %w", err)
+	return indexed, failed, first
+}
+
+// bulkIndices counts the documents of a bulk request per target index and
+// keeps the target of every action in body order.
+type bulkIndices struct {
+	counts  map[string]int
+	actions []string
+}
+
+func newBulkIndices() *bulkIndices {
+	return &bulkIndices{counts: map[string]int{}}
+}
+
+func (b *bulkIndices) add(index string) {
+	b.counts[index]++
+	b.actions = append(b.actions, index)
+}
+
+// target returns the index action i was sent to, fallback when unknown.
+func (b *bulkIndices) target(i int, fallback string) string {
+	if i < len(b.actions) {
+		return b.actions[i]
 	}
-	defer res.Body.Close()
+	return fallback
+}
 
-	if res.IsError() {
-		return fmt.Errorf("bulk indexing error: %s", res.String())
+func (b *bulkIndices) docs() int {
+	n := 0
+	for _, count := range b.counts {
+		n += count
 	}
-	log.Printf("Indexed %d docs into %s", len(processed), index)
-	return nil
+	return n
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"log"
 	"mongo-es/utils"
+	"reflect"
 	"testing"
 	"time"
 
@@ -39,3 +40,46 @@ func TestBulkInsert(t *testing.T) {
 
 	log.Println("bulk insert test finished OK")
 }
+
+func TestBulkResults(t *testing.T) {
+	bulkRes := bulkResponse{Errors: true, Items: []map[string]bulkItem{
+		{"index": {Index: "users", ID: "1", Status: 201}},
+		{"index": {Index: "users", ID: "2", Status: 409, Error: &bulkItemError{Type: "version_conflict_engine_exception"}}},
+		{"index": {Index: "users", ID: "3", Status: 400, Error: &bulkItemError{Type: "mapper_parsing_exception", Reason: "bad"}}},
+		{"index": {Index: "users", ID: "4", Status: 400, Error: &bulkItemError{Type: "mapper_parsing_exception", Reason: "worse"}}},
+	}}
+	indices := newBulkIndices()
+	for range 4 {
+		indices.add("users")
+	}
+	indexed, failed, err := bulkResults(bulkRes, indices)
+	if indexed != 1 || failed != 2 {
+		t.Fatalf("got %d indexed %d failed", indexed, failed)
+	}
+	if err == nil || err.Error() != "failed doc 3: mapper_parsing_exception: bad" {
+		t.Fatalf("expected the first failure, got %v", err)
+	}
+	if indices.counts["users"] != 3 {
+		t.Fatalf("stale doc should not count as indexed, got %d", indices.counts["users"])
+	}
+}
+
+func TestBulkResultsAlias(t *testing.T) {
+	// rollover writes go to the logs alias, items name its write index
+	bulkRes := bulkResponse{Errors: true, Items: []map[string]bulkItem{
+		{"index": {Index: "logs-000002", ID: "1", Status: 201}},
+		{"index": {Index: "logs-000002", ID: "2", Status: 409, Error: &bulkItemError{Type: "version_conflict_engine_exception"}}},
+		{"index": {Index: "users-v1", ID: "3", Status: 409, Error: &bulkItemError{Type: "version_conflict_engine_exception"}}},
+	}}
+	indices := newBulkIndices()
+	indices.add("logs")
+	indices.add("logs")
+	indices.add("users")
+	if _, _, err := bulkResults(bulkRes, indices); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"logs": 1, "users": 0}
+	if !reflect.DeepEqual(indices.counts, want) {
+		t.Fatalf("got %v want %v", indices.counts, want)
+	}
+}
@@ -0,0 +1,278 @@
+package es
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// strings longer than this, or containing whitespace, are treated as full text
+const textMinLen = 256
+
+type inferredField struct {
+	Type  string
+	Props map[string]*inferredField
+}
+
+type Inference struct {
+	root      map[string]*inferredField
+	conflicts map[string]string
+}
+
+func NewInference() *Inference {
+	return &Inference{
+		root:      make(map[string]*inferredField),
+		conflicts: make(map[string]string),
+	}
+}
+
+func (in *Inference) Add(doc map[string]any) {
+	for key, value := range doc {
+		in.addPath(in.root, "", strings.Split(key, "."), value)
+	}
+}
+
+func (in *Inference) addPath(props map[string]*inferredField, parent string, keys []string, value any) {
+	name := keys[0]
+	if parent != "" {
+		name = parent + "." + keys[0]
+	}
+	if len(keys) > 1 {
+		field, ok := props[keys[0]]
+		if !ok {
+			field = &inferredField{Type: "object", Props: make(map[string]*inferredField)}
+			props[keys[0]] = field
+		}
+		if field.Props == nil {
+			in.conflicts[name] = fmt.Sprintf("%s vs object, using object", field.Type)
+			field.Type = "object"
+			field.Props = make(map[string]*inferredField)
+		}
+		in.addPath(field.Props, name, keys[1:], value)
+		return
+	}
+	in.merge(props, name, keys[0], in.infer(name, value))
+}
+
+func (in *Inference) infer(name string, value any) *inferredField {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case bool:
+		return &inferredField{Type: "boolean"}
+	case int, int32, int64:
+		return &inferredField{Type: "long"}
+	case float32, float64, primitive.Decimal128:
+		return &inferredField{Type: "double"}
+	case time.Time, primitive.DateTime, primitive.Timestamp:
+		return &inferredField{Type: "date"}
+	case primitive.ObjectID:
+		return &inferredField{Type: "keyword"}
+	case string:
+		return &inferredField{Type: stringType(v)}
+	case map[string]any:
+		return in.inferObject(name, v)
+	case bson.M:
+		return in.inferObject(name, v)
+	case bson.D:
+		return in.inferObject(name, v.Map())
+	case bson.A:
+		return in.inferArray(name, v)
+	case []any:
+		return in.inferArray(name, v)
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		items := make([]any, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			items = append(items, rv.Index(i).Interface())
+		}
+		return in.inferArray(name, items)
+	}
+	return &inferredField{Type: "keyword"}
+}
+
+func (in *Inference) inferObject(name string, obj map[string]any) *inferredField {
+	if isGeoPoint(obj) {
+		return &inferredField{Type: "geo_point"}
+	}
+	field := &inferredField{Type: "object", Props: make(map[string]*inferredField)}
+	for key, value := range obj {
+		in.addPath(field.Props, name, strings.Split(key, "."), value)
+	}
+	return field
+}
+
+func (in *Inference) inferArray(name string, items []any) *inferredField {
+	var elem *inferredField
+	holder := map[string]*inferredField{}
+	for _, item := range items {
+		in.merge(holder, name, "elem", in.infer(name, item))
+	}
+	elem = holder["elem"]
+	if elem != nil && elem.Type == "object" {
+		elem.Type = "nested"
+	}
+	return elem
+}
+
+func (in *Inference) merge(props map[string]*inferredField, name, key string, next *inferredField) {
+	if next == nil {
+		return
+	}
+	prev, ok := props[key]
+	if !ok {
+		props[key] = next
+		return
+	}
+	switch {
+	case prev.Type == next.Type:
+	case isNumeric(prev.Type) && isNumeric(next.Type):
+		prev.Type = "double"
+		return
+	case isString(prev.Type) && isString(next.Type):
+		prev.Type = "text"
+		return
+	case isObject(prev.Type) && isObject(next.Type):
+		prev.Type = "nested"
+	case isObject(prev.Type) || isObject(next.Type):
+		// the object side keeps its properties whatever the sample order
+		object, value := prev, next
+		if isObject(next.Type) {
+			object, value = next, prev
+		}
+		in.conflicts[name] = fmt.Sprintf("%s vs %s, using %s", value.Type, object.Type, object.Type)
+		props[key] = object
+		return
+	default:
+		in.conflicts[name] = fmt.Sprintf("%s vs %s, using keyword", prev.Type, next.Type)
+		props[key] = &inferredField{Type: "keyword"}
+		return
+	}
+	for k, v := range next.Props {
+		in.merge(prev.Props, name+"."+k, k, v)
+	}
+}
+
+func (in *Inference) Mappings() map[string]any {
+	return map[string]any{
+		"properties": properties(in.root),
+	}
+}
+
+func (in *Inference) Conflicts() []string {
+	out := make([]string, 0, len(in.conflicts))
+	for field, conflict := range in.conflicts {
+		out = append(out, fmt.Sprintf("%s: %s", field, conflict))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func properties(props map[string]*inferredField) map[string]any {
+	out := make(map[string]any, len(props))
+	for key, field := range props {
+		prop := map[string]any{"type": field.Type}
+		switch field.Type {
+		case "object", "nested":
+			prop["properties"] = properties(field.Props)
+		case "text":
+			prop["fields"] = map[string]any{
+				"keyword": map[string]any{"type": "keyword", "ignore_above": 256},
+			}
+		}
+		out[key] = prop
+	}
+	return out
+}
+
+// IndexTemplate matches prefix and prefix-*, which overlaps the template of a
+// longer prefix like prefix-events. The longer prefix gets the higher priority
+// so its indices use their own template.
+func IndexTemplate(prefix string, in *Inference) map[string]any {
+	return map[string]any{
+		"index_patterns": []string{prefix, prefix + "-*"},
+		"priority":       len(prefix),
+		"template": map[string]any{
+			"mappings": in.Mappings(),
+		},
+		"_meta": map[string]any{
+			"generated_by": "mongoes infer",
+			"conflicts":    in.Conflicts(),
+		},
+	}
+}
+
+func WriteTemplate(dir, prefix string, template map[string]any) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %s", dir, err.Error())
+	}
+	data, err := json.MarshalIndent(template, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal %s template: %w", prefix, err)
+	}
+	file := path.Join(dir, fmt.Sprintf("%s.json", prefix))
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %s", file, err.Error())
+	}
+	return file, nil
+}
+
+func stringType(s string) string {
+	for _, layout := range []string{time.RFC3339Nano, time.DateTime, time.DateOnly} {
+		if _, err := time.Parse(layout, s); err == nil {
+			return "date"
+		}
+	}
+	if len(s) > textMinLen || strings.IndexFunc(s, unicode.IsSpace) >= 0 {
+		return "text"
+	}
+	return "keyword"
+}
+
+func isGeoPoint(obj map[string]any) bool {
+	if t, ok := obj["type"].(string); ok && t == "Point" && len(obj) == 2 {
+		coords, ok := obj["coordinates"]
+		if !ok {
+			return false
+		}
+		rv := reflect.ValueOf(coords)
+		if (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) || rv.Len() != 2 {
+			return false
+		}
+		return isNumber(rv.Index(0).Interface()) && isNumber(rv.Index(1).Interface())
+	}
+	if len(obj) == 2 {
+		return isNumber(obj["lat"]) && isNumber(obj["lon"])
+	}
+	return false
+}
+
+func isNumber(v any) bool {
+	switch v.(type) {
+	case int, int32, int64, float32, float64:
+		return true
+	}
+	return false
+}
+
+func isNumeric(t string) bool {
+	return t == "long" || t == "double"
+}
+
+func isString(t string) bool {
+	return t == "keyword" || t == "text"
+}
+
+func isObject(t string) bool {
+	return t == "object" || t == "nested"
+}
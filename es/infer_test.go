@@ -0,0 +1,133 @@
+package es
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func propType(t *testing.T, props map[string]any, path ...string) string {
+	t.Helper()
+	var prop map[string]any
+	for i, key := range path {
+		p, ok := props[key].(map[string]any)
+		if !ok {
+			t.Fatalf("missing property %v in %#v", path[:i+1], props)
+		}
+		prop = p
+		if i < len(path)-1 {
+			props, _ = prop["properties"].(map[string]any)
+		}
+	}
+	return prop["type"].(string)
+}
+
+func TestInference_Types(t *testing.T) {
+	in := NewInference()
+	in.Add(map[string]any{
+		"_id":           primitive.NewObjectID(),
+		"name":          "alice",
+		"bio":           "likes long walks",
+		"age":           int32(30),
+		"score":         1.5,
+		"active":        true,
+		"created_at":    primitive.NewDateTimeFromTime(time.Now()),
+		"joined":        "2025-08-21T14:51:43.000Z",
+		"stats.country": "US",
+		"location":      map[string]any{"lat": 35.7, "lon": 51.4},
+		"geo":           map[string]any{"type": "Point", "coordinates": bson.A{51.4, 35.7}},
+		"tags":          bson.A{"a", "b"},
+		"items":         bson.A{map[string]any{"sku": "x", "qty": int32(1)}},
+	})
+	props := in.Mappings()["properties"].(map[string]any)
+
+	want := map[string][]string{
+		"keyword":   {"_id", "name"},
+		"text":      {"bio"},
+		"long":      {"age"},
+		"double":    {"score"},
+		"boolean":   {"active"},
+		"date":      {"created_at", "joined"},
+		"geo_point": {"location", "geo"},
+		"object":    {"stats"},
+		"nested":    {"items"},
+	}
+	for typ, fields := range want {
+		for _, field := range fields {
+			if got := propType(t, props, field); got != typ {
+				t.Errorf("%s: expected %s, got %s", field, typ, got)
+			}
+		}
+	}
+	if got := propType(t, props, "stats", "country"); got != "keyword" {
+		t.Errorf("stats.country: expected keyword, got %s", got)
+	}
+	if got := propType(t, props, "tags"); got != "keyword" {
+		t.Errorf("tags: expected keyword, got %s", got)
+	}
+	if got := propType(t, props, "items", "qty"); got != "long" {
+		t.Errorf("items.qty: expected long, got %s", got)
+	}
+	if len(in.Conflicts()) != 0 {
+		t.Errorf("expected no conflicts, got %v", in.Conflicts())
+	}
+}
+
+func TestInference_Conflicts(t *testing.T) {
+	in := NewInference()
+	in.Add(map[string]any{"count": int64(1), "code": "abc", "label": "short"})
+	in.Add(map[string]any{"count": 2.5, "code": int32(7), "label": "much longer text"})
+	props := in.Mappings()["properties"].(map[string]any)
+
+	if got := propType(t, props, "count"); got != "double" {
+		t.Errorf("count: expected double, got %s", got)
+	}
+	if got := propType(t, props, "label"); got != "text" {
+		t.Errorf("label: expected text, got %s", got)
+	}
+	if got := propType(t, props, "code"); got != "keyword" {
+		t.Errorf("code: expected keyword, got %s", got)
+	}
+	want := []string{"code: keyword vs long, using keyword"}
+	if !reflect.DeepEqual(in.Conflicts(), want) {
+		t.Fatalf("got %v want %v", in.Conflicts(), want)
+	}
+}
+
+func TestInference_ObjectConflict(t *testing.T) {
+	samples := map[string][]map[string]any{
+		"dotted key":   {{"user": "alice"}, {"user.name": "bob"}},
+		"value first":  {{"user": "alice"}, {"user": map[string]any{"name": "bob"}}},
+		"object first": {{"user": map[string]any{"name": "bob"}}, {"user": "alice"}},
+	}
+	for name, docs := range samples {
+		in := NewInference()
+		for _, doc := range docs {
+			in.Add(doc)
+		}
+		props := in.Mappings()["properties"].(map[string]any)
+		if got := propType(t, props, "user"); got != "object" {
+			t.Errorf("%s: user: expected object, got %s", name, got)
+			continue
+		}
+		user := props["user"].(map[string]any)["properties"].(map[string]any)
+		if got := propType(t, user, "name"); got != "keyword" {
+			t.Errorf("%s: user.name: expected keyword, got %s", name, got)
+		}
+		want := []string{"user: keyword vs object, using object"}
+		if !reflect.DeepEqual(in.Conflicts(), want) {
+			t.Errorf("%s: got %v want %v", name, in.Conflicts(), want)
+		}
+	}
+}
+
+func TestIndexTemplatePriority(t *testing.T) {
+	in := NewInference()
+	user, events := IndexTemplate("user", in), IndexTemplate("user-events", in)
+	if user["priority"].(int) >= events["priority"].(int) {
+		t.Errorf("user-events should win over user-*, got %v and %v", user["priority"], events["priority"])
+	}
+}
@@ -0,0 +1,130 @@
+package es
+
+import (
+	"bytes"
+	"fmt"
+	"mongo-es/utils"
+	"strconv"
+	"text/template"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var defaultPatterns = map[string]string{
+	"fixed":   `{{.Prefix}}`,
+	"hourly":  `{{.Prefix}}-{{.Time.Format "2006-01-02-15"}}`,
+	"daily":   `{{.Prefix}}-{{.Time.Format "2006-01-02"}}`,
+	"weekly":  `{{.Prefix}}-{{.Year}}-w{{printf "%02d" .Week}}`,
+	"monthly": `{{.Prefix}}-{{.Time.Format "2006-01"}}`,
+	"period":  `{{.Prefix}}-{{.Time.Format "2006-01-02"}}`,
+}
+
+type indexNameData struct {
+	Prefix string
+	Time   time.Time
+	Year   int
+	Week   int
+}
+
+type indexNamer struct {
+	prefix    string
+	strategy  string
+	timeField string
+	period    time.Duration
+	tmpl      *template.Template
+}
+
+func newIndexNamer(prefix string, naming utils.IndexNamingConf, periodHours int) (*indexNamer, error) {
+	pattern := naming.Pattern
+	if pattern == "" {
+		p, ok := defaultPatterns[naming.Strategy]
+		if !ok {
+			return nil, fmt.Errorf("unknown index naming strategy %q for %s", naming.Strategy, prefix)
+		}
+		pattern = p
+		if naming.Strategy == "period" && periodHours < 24 {
+			pattern = defaultPatterns["hourly"]
+		}
+	} else if _, ok := defaultPatterns[naming.Strategy]; !ok {
+		return nil, fmt.Errorf("unknown index naming strategy %q for %s", naming.Strategy, prefix)
+	}
+	if periodHours <= 0 {
+		periodHours = 24
+	}
+	tmpl, err := template.New(prefix).Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid index pattern for %s: %w", prefix, err)
+	}
+	return &indexNamer{
+		prefix:    prefix,
+		strategy:  naming.Strategy,
+		timeField: naming.TimeField,
+		period:    time.Duration(periodHours) * time.Hour,
+		tmpl:      tmpl,
+	}, nil
+}
+
+func (n *indexNamer) Name(doc map[string]any, now time.Time) (string, error) {
+	t := now
+	if n.timeField != "" {
+		value, _ := utils.Lookup(doc, n.timeField)
+		if docTime, ok := toTime(value); ok {
+			t = docTime
+		}
+	}
+	t = n.bucket(t.UTC())
+	year, week := t.ISOWeek()
+	var buf bytes.Buffer
+	if err := n.tmpl.Execute(&buf, indexNameData{
+		Prefix: n.prefix,
+		Time:   t,
+		Year:   year,
+		Week:   week,
+	}); err != nil {
+		return "", fmt.Errorf("failed to render index name for %s: %w", n.prefix, err)
+	}
+	return buf.String(), nil
+}
+
+func (n *indexNamer) bucket(t time.Time) time.Time {
+	switch n.strategy {
+	case "hourly":
+		return t.Truncate(time.Hour)
+	case "daily":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case "weekly":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case "monthly":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case "period":
+		return t.Truncate(n.period)
+	}
+	return t
+}
+
+func toTime(v any) (time.Time, bool) {
+	switch val := v.(type) {
+	case time.Time:
+		return val, true
+	case primitive.DateTime:
+		return val.Time(), true
+	case primitive.Timestamp:
+		return time.Unix(int64(val.T), 0), true
+	case int64:
+		return time.UnixMilli(val), true
+	case float64:
+		return time.UnixMilli(int64(val)), true
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, time.DateTime, time.DateOnly} {
+			if t, err := time.Parse(layout, val); err == nil {
+				return t, true
+			}
+		}
+		if ms, err := strconv.ParseInt(val, 10, 64); err == nil {
+			return time.UnixMilli(ms), true
+		}
+	}
+	return time.Time{}, false
+}
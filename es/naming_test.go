@@ -0,0 +1,74 @@
+package es
+
+import (
+	"mongo-es/utils"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestIndexNamer_Strategies(t *testing.T) {
+	now := time.Date(2025, 8, 21, 14, 51, 43, 0, time.UTC)
+	cases := []struct {
+		naming utils.IndexNamingConf
+		period int
+		want   string
+	}{
+		{utils.IndexNamingConf{Strategy: "fixed"}, 24, "logs"},
+		{utils.IndexNamingConf{Strategy: "hourly"}, 24, "logs-2025-08-21-14"},
+		{utils.IndexNamingConf{Strategy: "daily"}, 24, "logs-2025-08-21"},
+		{utils.IndexNamingConf{Strategy: "weekly"}, 24, "logs-2025-w34"},
+		{utils.IndexNamingConf{Strategy: "monthly"}, 24, "logs-2025-08"},
+		{utils.IndexNamingConf{Strategy: "period"}, 24, "logs-2025-08-21"},
+		{utils.IndexNamingConf{Strategy: "period"}, 6, "logs-2025-08-21-12"},
+		{utils.IndexNamingConf{Strategy: "weekly", Pattern: `{{.Prefix}}_{{.Time.Format "20060102"}}`}, 24, "logs_20250818"},
+	}
+	for _, c := range cases {
+		n, err := newIndexNamer("logs", c.naming, c.period)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := n.Name(map[string]any{}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%+v: expected %s, got %s", c.naming, c.want, got)
+		}
+	}
+}
+
+func TestIndexNamer_TimeField(t *testing.T) {
+	n, err := newIndexNamer("events", utils.IndexNamingConf{Strategy: "daily", TimeField: "created_at"}, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 8, 21, 0, 0, 0, 0, time.UTC)
+	docTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	cases := []struct {
+		doc  map[string]any
+		want string
+	}{
+		{map[string]any{"created_at": primitive.NewDateTimeFromTime(docTime)}, "events-2024-01-02"},
+		{map[string]any{"created_at": "2024-01-02T03:04:05Z"}, "events-2024-01-02"},
+		{map[string]any{"created_at": docTime.UnixMilli()}, "events-2024-01-02"},
+		{map[string]any{"other": 1}, "events-2025-08-21"},
+	}
+	for _, c := range cases {
+		got, err := n.Name(c.doc, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%v: expected %s, got %s", c.doc, c.want, got)
+		}
+	}
+}
+
+func TestIndexNamer_UnknownStrategy(t *testing.T) {
+	if _, err := newIndexNamer("logs", utils.IndexNamingConf{Strategy: "yearly"}, 24); err == nil {
+		t.Fatal("expected error for unknown strategy")
+	}
+}
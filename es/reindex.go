@@ -0,0 +1,201 @@
+package es
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"time"
+)
+
+type dualWrite struct {
+	Index string `json:"index"`
+}
+
+func (es *EsClient) dualWriteFile(prefix string) string {
+	return path.Join(es.cfg.Elastic.GetReindexDir(), fmt.Sprintf("%s.json", prefix))
+}
+
+// DualWriteIndex returns the index a running reindex of prefix is backfilling,
+// live batches are written to it as well until the alias is swapped.
+func (es *EsClient) DualWriteIndex(prefix string) (string, bool, error) {
+	data, err := os.ReadFile(es.dualWriteFile(prefix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to read %s reindex state: %s", prefix, err.Error())
+	}
+	var state dualWrite
+	if err := json.Unmarshal(data, &state); err != nil {
+		return "", false, fmt.Errorf("failed to parse %s reindex state: %w", prefix, err)
+	}
+	return state.Index, state.Index != "", nil
+}
+
+func (es *EsClient) StartDualWrite(prefix, index string) error {
+	if _, running, err := es.DualWriteIndex(prefix); err != nil {
+		return err
+	} else if running {
+		return fmt.Errorf("a reindex of %s is already running, remove %s if it was aborted", prefix, es.dualWriteFile(prefix))
+	}
+	data, err := json.Marshal(dualWrite{Index: index})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(es.cfg.Elastic.GetReindexDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create reindex dir: %s", err.Error())
+	}
+	if err := os.WriteFile(es.dualWriteFile(prefix), data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s reindex state: %s", prefix, err.Error())
+	}
+	return nil
+}
+
+func (es *EsClient) StopDualWrite(prefix string) error {
+	if err := os.Remove(es.dualWriteFile(prefix)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s reindex state: %s", prefix, err.Error())
+	}
+	return nil
+}
+
+// backfiller writes the documents of prefix routed to prefix into index, the
+// other destinations of its routes are not rebuilt.
+func (es *EsClient) backfiller(prefix, index string) (func(map[string]any) ([]string, error), error) {
+	router, err := es.router(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return func(doc map[string]any) ([]string, error) {
+		if router.route(doc) != prefix {
+			return nil, nil
+		}
+		return []string{index}, nil
+	}, nil
+}
+
+// VersionedIndex names the index a reindex of prefix builds, it matches the
+// prefix-* pattern of the prefix template so it gets its mappings.
+func VersionedIndex(prefix string, now time.Time) string {
+	return fmt.Sprintf("%s-v%s", prefix, now.UTC().Format("20060102150405"))
+}
+
+func (es *EsClient) CreateIndex(ctx context.Context, index string) error {
+	res, err := es.client.Indices.Create(index, es.client.Indices.Create.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("failed to create %s: %s", index, res.String())
+	}
+	return nil
+}
+
+// SwapAlias atomically points alias at index and returns the indices it was
+// removed from. A concrete index named like the alias is deleted by the swap
+// only with deleteIndex, otherwise the swap fails.
+func (es *EsClient) SwapAlias(ctx context.Context, alias, index string, deleteIndex bool) ([]string, error) {
+	res, err := es.client.Indices.GetAlias(
+		es.client.Indices.GetAlias.WithName(alias),
+		es.client.Indices.GetAlias.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get alias %s: %w", alias, err)
+	}
+	defer res.Body.Close()
+
+	old := []string{}
+	actions := []map[string]any{}
+	switch {
+	case res.StatusCode == 200:
+		var current map[string]any
+		if err := json.NewDecoder(res.Body).Decode(&current); err != nil {
+			return nil, fmt.Errorf("decode alias %s: %w", alias, err)
+		}
+		for oldIndex := range current {
+			old = append(old, oldIndex)
+			actions = append(actions, map[string]any{
+				"remove": map[string]any{"index": oldIndex, "alias": alias},
+			})
+		}
+	case res.StatusCode == 404:
+		concrete, err := es.CheckAliasIndex(ctx, alias, deleteIndex)
+		if err != nil {
+			return nil, err
+		}
+		if concrete {
+			actions = append(actions, map[string]any{
+				"remove_index": map[string]any{"index": alias},
+			})
+		}
+	default:
+		return nil, fmt.Errorf("failed to get alias %s: %s", alias, res.String())
+	}
+	actions = append(actions, map[string]any{
+		"add": map[string]any{"index": index, "alias": alias},
+	})
+
+	data, err := json.Marshal(map[string]any{"actions": actions})
+	if err != nil {
+		return nil, err
+	}
+	swap, err := es.client.Indices.UpdateAliases(bytes.NewReader(data),
+		es.client.Indices.UpdateAliases.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to swap alias %s: %w", alias, err)
+	}
+	defer swap.Body.Close()
+	if swap.IsError() {
+		return nil, fmt.Errorf("failed to swap alias %s: %s", alias, swap.String())
+	}
+	slog.Info("swapped alias", "alias", alias, "index", index)
+	return old, nil
+}
+
+// CheckAliasIndex reports whether alias is still a concrete index, which fails
+// unless deleteIndex allows replacing it with the alias.
+func (es *EsClient) CheckAliasIndex(ctx context.Context, alias string, deleteIndex bool) (bool, error) {
+	res, err := es.client.Indices.Get([]string{alias}, es.client.Indices.Get.WithContext(ctx))
+	if err != nil {
+		return false, fmt.Errorf("failed to check index %s: %w", alias, err)
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == 404:
+		return false, nil
+	case res.IsError():
+		return false, fmt.Errorf("failed to check index %s: %s", alias, res.String())
+	}
+	var indices map[string]any
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return false, fmt.Errorf("decode index %s: %w", alias, err)
+	}
+	if _, concrete := indices[alias]; !concrete {
+		return false, nil
+	}
+	if !deleteIndex {
+		return true, fmt.Errorf("%s is an index, not an alias, rerun with -delete-old to replace it with the alias", alias)
+	}
+	return true, nil
+}
+
+func (es *EsClient) DeleteIndices(ctx context.Context, indices []string) error {
+	if len(indices) == 0 {
+		return nil
+	}
+	res, err := es.client.Indices.Delete(indices, es.client.Indices.Delete.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to delete %v: %w", indices, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("failed to delete %v: %s", indices, res.String())
+	}
+	slog.Info("deleted indices", "indices", indices)
+	return nil
+}
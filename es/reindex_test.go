@@ -0,0 +1,149 @@
+package es
+
+import (
+	"bytes"
+	"context"
+	"mongo-es/utils"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDualWriteState(t *testing.T) {
+	es := NewEsClient(&utils.Conf{Elastic: utils.ElasticConf{ReindexDir: path.Join(t.TempDir(), "reindex")}})
+
+	if _, running, err := es.DualWriteIndex("users"); err != nil || running {
+		t.Fatalf("expected no reindex running, got running=%v err=%v", running, err)
+	}
+	if err := es.StartDualWrite("users", "users-v1"); err != nil {
+		t.Fatal(err)
+	}
+	index, running, err := es.DualWriteIndex("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !running || index != "users-v1" {
+		t.Fatalf("expected dual write to users-v1, got %q running=%v", index, running)
+	}
+	if err := es.StartDualWrite("users", "users-v2"); err == nil {
+		t.Fatal("expected error starting a second reindex")
+	}
+	if err := es.StopDualWrite("users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, running, _ := es.DualWriteIndex("users"); running {
+		t.Fatal("expected dual write to stop")
+	}
+	if err := es.StopDualWrite("users"); err != nil {
+		t.Fatalf("stopping twice should be a no-op: %v", err)
+	}
+}
+
+func TestVersionedIndex(t *testing.T) {
+	now := time.Date(2025, 8, 21, 14, 51, 43, 0, time.UTC)
+	index := VersionedIndex("user_index", now)
+	if index != "user_index-v20250821145143" {
+		t.Fatalf("got %s", index)
+	}
+	// the rebuilt index gets the mappings of the inferred template
+	patterns := IndexTemplate("user_index", NewInference())["index_patterns"].([]string)
+	if !slices.ContainsFunc(patterns, func(pattern string) bool {
+		ok, _ := path.Match(pattern, index)
+		return ok
+	}) {
+		t.Fatalf("%s matches none of %v", index, patterns)
+	}
+}
+
+func TestBackfillVersioning(t *testing.T) {
+	cfg := &utils.Conf{Elastic: utils.ElasticConf{
+		Versioning: map[string]utils.VersioningConf{"events": {Field: "version", Type: "external"}},
+	}}
+	es := NewEsClient(cfg)
+	indicesFor, err := es.backfiller("events", "events-v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	docs := []map[string]any{{"_id": "1", "version": int64(3)}}
+	if err := es.appendBulk(context.Background(), &buf, newBulkIndices(), mapDocs(docs), "events", indicesFor, true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `{"index":{"_index":"events-v1","_id":"1","version":3,"version_type":"external"}}`) {
+		t.Errorf("versioned backfill should index with its version:\n%s", buf.String())
+	}
+}
+
+func TestBackfillRoutes(t *testing.T) {
+	cfg := &utils.Conf{Elastic: utils.ElasticConf{
+		Routes: map[string]utils.RoutesConf{"events": {
+			Rules: []utils.RouteRule{
+				{Field: "type", Equals: strPtr("audit"), Index: "audit"},
+				{Field: "type", Equals: strPtr("debug"), Index: dropRoute},
+			},
+			Default: "events",
+		}},
+	}}
+	es := NewEsClient(cfg)
+	indicesFor, err := es.backfiller("events", "events-v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	indices := newBulkIndices()
+	docs := []map[string]any{
+		{"_id": "1", "type": "audit"},
+		{"_id": "2", "type": "debug"},
+		{"_id": "3", "type": "click"},
+	}
+	if err := es.appendBulk(context.Background(), &buf, indices, mapDocs(docs), "events", indicesFor, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(indices.counts) != 1 || indices.counts["events-v1"] != 1 {
+		t.Fatalf("unexpected indices %v", indices.counts)
+	}
+	body := buf.String()
+	if !strings.Contains(body, `{"create":{"_index":"events-v1","_id":"3"}}`) {
+		t.Errorf("events doc not backfilled:\n%s", body)
+	}
+	if strings.Contains(body, `"_id":"1"`) || strings.Contains(body, `"_id":"2"`) {
+		t.Errorf("doc routed away from events was backfilled:\n%s", body)
+	}
+}
+
+func TestCheckAliasIndex(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		switch r.URL.Path {
+		case "/users":
+			w.Write([]byte(`{"users":{}}`))
+		case "/orders":
+			// an alias resolves to its indices
+			w.Write([]byte(`{"orders-v1":{}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer srv.Close()
+	es := NewEsClient(&utils.Conf{Elastic: utils.ElasticConf{Addresses: []string{srv.URL}}})
+	if err := es.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := es.CheckAliasIndex(ctx, "users", false); err == nil {
+		t.Error("expected error replacing index users without -delete-old")
+	}
+	if concrete, err := es.CheckAliasIndex(ctx, "users", true); err != nil || !concrete {
+		t.Errorf("expected users to be replaced, got %v %v", concrete, err)
+	}
+	for _, name := range []string{"orders", "missing"} {
+		if concrete, err := es.CheckAliasIndex(ctx, name, false); err != nil || concrete {
+			t.Errorf("%s: expected no concrete index, got %v %v", name, concrete, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package es
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mongo-es/utils"
+	"os"
+	"path"
+	"slices"
+)
+
+func (es *EsClient) BootstrapRollover(ctx context.Context) error {
+	for prefix := range es.cfg.Elastic.Rollover {
+		rc, _ := es.cfg.Elastic.GetRollover(prefix)
+		if rc.Policy != "" {
+			if err := es.putPolicy(ctx, rc.Policy); err != nil {
+				return err
+			}
+		}
+		if !rc.Bootstrap {
+			continue
+		}
+		templateFile := path.Join(es.cfg.Elastic.TemplatesDir, fmt.Sprintf("%s.json", prefix))
+		if _, err := os.Stat(templateFile); os.IsNotExist(err) {
+			template := rolloverTemplate(rc, map[string]any{
+				"index_patterns": []any{prefix + "-*"},
+			})
+			if err := es.putTemplate(ctx, prefix, template); err != nil {
+				return err
+			}
+		}
+		if err := es.bootstrapAlias(ctx, rc.Alias); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (es *EsClient) putPolicy(ctx context.Context, name string) error {
+	policy, ok := es.cfg.Elastic.ILMPolicies[name]
+	if !ok {
+		// not defined in config, expected to already exist in the cluster
+		return nil
+	}
+	data, err := json.Marshal(map[string]any{"policy": policy})
+	if err != nil {
+		return fmt.Errorf("failed to marshal ilm policy %s: %w", name, err)
+	}
+	res, err := es.client.ILM.PutLifecycle(name,
+		es.client.ILM.PutLifecycle.WithBody(bytes.NewReader(data)),
+		es.client.ILM.PutLifecycle.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to put ilm policy %s: %w", name, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("failed to put ilm policy %s: %s", name, res.String())
+	}
+	slog.Info("applied ilm policy", "policy", name)
+	return nil
+}
+
+func (es *EsClient) bootstrapAlias(ctx context.Context, alias string) error {
+	res, err := es.client.Indices.ExistsAlias([]string{alias},
+		es.client.Indices.ExistsAlias.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to check alias %s: %w", alias, err)
+	}
+	res.Body.Close()
+	if res.StatusCode == 200 {
+		return nil
+	}
+	data, err := json.Marshal(map[string]any{
+		"aliases": map[string]any{
+			alias: map[string]any{"is_write_index": true},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s bootstrap index: %w", alias, err)
+	}
+	index := fmt.Sprintf("%s-000001", alias)
+	res, err = es.client.Indices.Create(index,
+		es.client.Indices.Create.WithBody(bytes.NewReader(data)),
+		es.client.Indices.Create.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("failed to create %s: %s", index, res.String())
+	}
+	slog.Info("bootstrapped write alias", "index", index, "alias", alias)
+	return nil
+}
+
+func rolloverTemplate(rc utils.RolloverConf, template map[string]any) map[string]any {
+	var patterns []any
+	// index_patterns accepts a single pattern too
+	switch v := template["index_patterns"].(type) {
+	case string:
+		patterns = []any{v}
+	case []any:
+		patterns = v
+	case []string:
+		for _, pattern := range v {
+			patterns = append(patterns, pattern)
+		}
+	}
+	template["index_patterns"] = patterns
+	if !slices.Contains(patterns, any(rc.Alias+"-*")) {
+		template["index_patterns"] = append(patterns, rc.Alias+"-*")
+	}
+	body, ok := template["template"].(map[string]any)
+	if !ok {
+		body = map[string]any{}
+		template["template"] = body
+	}
+	settings, ok := body["settings"].(map[string]any)
+	if !ok {
+		settings = map[string]any{}
+		body["settings"] = settings
+	}
+	settings["index.lifecycle.rollover_alias"] = rc.Alias
+	if rc.Policy != "" {
+		settings["index.lifecycle.name"] = rc.Policy
+	}
+	return template
+}
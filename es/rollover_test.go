@@ -0,0 +1,70 @@
+package es
+
+import (
+	"mongo-es/utils"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRolloverTemplate(t *testing.T) {
+	rc := utils.RolloverConf{Alias: "logs-write", Policy: "hot-warm"}
+	template := map[string]any{
+		"index_patterns": []any{"logs", "logs-*"},
+		"template": map[string]any{
+			"mappings": map[string]any{"properties": map[string]any{}},
+		},
+	}
+	got := rolloverTemplate(rc, template)
+
+	wantPatterns := []any{"logs", "logs-*", "logs-write-*"}
+	if !reflect.DeepEqual(got["index_patterns"], wantPatterns) {
+		t.Fatalf("patterns: got %v want %v", got["index_patterns"], wantPatterns)
+	}
+	body := got["template"].(map[string]any)
+	if _, ok := body["mappings"]; !ok {
+		t.Fatal("mappings should be preserved")
+	}
+	wantSettings := map[string]any{
+		"index.lifecycle.name":           "hot-warm",
+		"index.lifecycle.rollover_alias": "logs-write",
+	}
+	if !reflect.DeepEqual(body["settings"], wantSettings) {
+		t.Fatalf("settings: got %v want %v", body["settings"], wantSettings)
+	}
+
+	again := rolloverTemplate(rc, got)
+	if !reflect.DeepEqual(again["index_patterns"], wantPatterns) {
+		t.Fatalf("patterns should not be duplicated, got %v", again["index_patterns"])
+	}
+}
+
+func TestRolloverTemplatePatternString(t *testing.T) {
+	rc := utils.RolloverConf{Alias: "logs-write"}
+	for _, patterns := range []any{"logs-*", []string{"logs-*"}} {
+		got := rolloverTemplate(rc, map[string]any{"index_patterns": patterns})
+		want := []any{"logs-*", "logs-write-*"}
+		if !reflect.DeepEqual(got["index_patterns"], want) {
+			t.Errorf("%#v: got %v want %v", patterns, got["index_patterns"], want)
+		}
+	}
+}
+
+func TestRolloverNamer(t *testing.T) {
+	cfg := &utils.Conf{Elastic: utils.ElasticConf{
+		IndexNaming: map[string]utils.IndexNamingConf{"logs": {Strategy: "daily"}},
+		Rollover:    map[string]utils.RolloverConf{"logs": {}},
+	}}
+	es := NewEsClient(cfg)
+	n, err := es.namer("logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := n.Name(map[string]any{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "logs" {
+		t.Fatalf("expected writes to the logs alias, got %s", got)
+	}
+}
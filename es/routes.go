@@ -0,0 +1,107 @@
+package es
+
+import (
+	"fmt"
+	"mongo-es/utils"
+	"regexp"
+	"slices"
+)
+
+// dropRoute is the route of documents that are not indexed, index names
+// cannot start with an underscore so it never clashes with a real index.
+const dropRoute = "_drop"
+
+type routeRule struct {
+	field  string
+	equals *string
+	regex  *regexp.Regexp
+	exists *bool
+	index  string
+}
+
+// router picks the index a document is written to from its content, the
+// first matching rule wins.
+type router struct {
+	rules    []routeRule
+	fallback string
+}
+
+func newRouter(prefix string, routes utils.RoutesConf) (*router, error) {
+	r := &router{fallback: routes.Default}
+	for i, rule := range routes.Rules {
+		if rule.Field == "" {
+			return nil, fmt.Errorf("route %d of %s needs a field", i, prefix)
+		}
+		if rule.Index == "" {
+			return nil, fmt.Errorf("route %d of %s needs an index", i, prefix)
+		}
+		conditions := 0
+		compiled := routeRule{field: rule.Field, equals: rule.Equals, exists: rule.Exists, index: rule.Index}
+		if rule.Equals != nil {
+			conditions++
+		}
+		if rule.Exists != nil {
+			conditions++
+		}
+		if rule.Regex != "" {
+			conditions++
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex for route %d of %s: %w", i, prefix, err)
+			}
+			compiled.regex = re
+		}
+		if conditions != 1 {
+			return nil, fmt.Errorf("route %d of %s needs one of equals, regex or exists", i, prefix)
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	return r, nil
+}
+
+// route returns the index prefix doc goes to, or dropRoute.
+func (r *router) route(doc map[string]any) string {
+	for _, rule := range r.rules {
+		if rule.match(doc) {
+			return rule.index
+		}
+	}
+	return r.fallback
+}
+
+func (rule routeRule) match(doc map[string]any) bool {
+	value, ok := utils.Lookup(doc, rule.field)
+	ok = ok && value != nil
+	switch {
+	case rule.exists != nil:
+		return ok == *rule.exists
+	case !ok:
+		return false
+	case rule.equals != nil:
+		return idString(value) == *rule.equals
+	}
+	return rule.regex.MatchString(idString(value))
+}
+
+// fields lists the document fields the rules read.
+func (r *router) fields() []string {
+	fields := make([]string, 0, len(r.rules))
+	for _, rule := range r.rules {
+		fields = append(fields, rule.field)
+	}
+	return fields
+}
+
+// destinations lists the indices documents can be routed to.
+func (r *router) destinations() []string {
+	dests := []string{}
+	for _, rule := range r.rules {
+		if rule.index != dropRoute && !slices.Contains(dests, rule.index) {
+			dests = append(dests, rule.index)
+		}
+	}
+	if r.fallback != dropRoute && !slices.Contains(dests, r.fallback) {
+		dests = append(dests, r.fallback)
+	}
+	return dests
+}
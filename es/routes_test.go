@@ -0,0 +1,97 @@
+package es
+
+import (
+	"bytes"
+	"context"
+	"mongo-es/utils"
+	"strings"
+	"testing"
+)
+
+func strPtr(s string) *string { return &s }
+func boolPtr(b bool) *bool    { return &b }
+
+func TestRouter(t *testing.T) {
+	r, err := newRouter("events", utils.RoutesConf{
+		Rules: []utils.RouteRule{
+			{Field: "debug", Exists: boolPtr(true), Index: dropRoute},
+			{Field: "type", Equals: strPtr("audit"), Index: "audit"},
+			{Field: "source", Regex: "^internal-", Index: "internal_events"},
+			{Field: "meta.level", Equals: strPtr("3"), Index: "alerts"},
+		},
+		Default: "events",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		doc  map[string]any
+		want string
+	}{
+		{map[string]any{"type": "audit", "debug": true}, dropRoute},
+		{map[string]any{"type": "audit", "debug": nil}, "audit"},
+		{map[string]any{"type": "click", "source": "internal-billing"}, "internal_events"},
+		{map[string]any{"meta": map[string]any{"level": int32(3)}}, "alerts"},
+		{map[string]any{"type": "click", "source": "web"}, "events"},
+		{map[string]any{}, "events"},
+	}
+	for _, c := range cases {
+		if got := r.route(c.doc); got != c.want {
+			t.Errorf("%v: got %s want %s", c.doc, got, c.want)
+		}
+	}
+	if got := r.destinations(); strings.Join(got, ",") != "audit,internal_events,alerts,events" {
+		t.Errorf("unexpected destinations %v", got)
+	}
+}
+
+func TestNewRouterErrors(t *testing.T) {
+	for _, rule := range []utils.RouteRule{
+		{Equals: strPtr("a"), Index: "a"},
+		{Field: "type", Equals: strPtr("a")},
+		{Field: "type", Index: "a"},
+		{Field: "type", Equals: strPtr("a"), Regex: "a", Index: "a"},
+		{Field: "type", Regex: "(", Index: "a"},
+	} {
+		if _, err := newRouter("events", utils.RoutesConf{Rules: []utils.RouteRule{rule}}); err == nil {
+			t.Errorf("expected error for %+v", rule)
+		}
+	}
+}
+
+func TestAppendBulkRoutes(t *testing.T) {
+	cfg := &utils.Conf{Elastic: utils.ElasticConf{
+		IndexNaming: map[string]utils.IndexNamingConf{"audit": {Strategy: "fixed", Pattern: "audit-all"}},
+		Routes: map[string]utils.RoutesConf{"events": {
+			Rules: []utils.RouteRule{
+				{Field: "type", Equals: strPtr("audit"), Index: "audit"},
+				{Field: "type", Equals: strPtr("debug"), Index: dropRoute},
+			},
+		}},
+	}}
+	es := NewEsClient(cfg)
+	indicesFor, err := es.resolver("events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	indices := newBulkIndices()
+	docs := []map[string]any{
+		{"_id": "1", "type": "audit"},
+		{"_id": "2", "type": "debug"},
+		{"_id": "3", "type": "click"},
+	}
+	if err := es.appendBulk(context.Background(), &buf, indices, mapDocs(docs), "events", indicesFor, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(indices.counts) != 2 || indices.counts["audit-all"] != 1 {
+		t.Fatalf("unexpected indices %v", indices.counts)
+	}
+	body := buf.String()
+	if strings.Contains(body, `"_id":"2"`) {
+		t.Errorf("dropped doc was indexed:\n%s", body)
+	}
+	if !strings.Contains(body, `{"index":{"_index":"audit-all","_id":"1"}}`) {
+		t.Errorf("audit doc not routed:\n%s", body)
+	}
+}
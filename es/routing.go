@@ -0,0 +1,48 @@
+package es
+
+import (
+	"fmt"
+	"mongo-es/utils"
+)
+
+func validateJoin(prefix string, join utils.JoinConf) error {
+	if join.Name == "" && join.NameField == "" {
+		return fmt.Errorf("join for %s needs a name or name_field", prefix)
+	}
+	return nil
+}
+
+// applyJoin sets the join field of doc and returns the parent id, if any.
+func applyJoin(doc map[string]any, join utils.JoinConf) (string, error) {
+	name := join.Name
+	if join.NameField != "" {
+		value, ok := utils.Lookup(doc, join.NameField)
+		if !ok || value == nil {
+			return "", fmt.Errorf("document missing join name field %q", join.NameField)
+		}
+		name = idString(value)
+	}
+	relation := map[string]any{"name": name}
+	parent := ""
+	if join.ParentField != "" {
+		if value, ok := utils.Lookup(doc, join.ParentField); ok && value != nil {
+			parent = idString(value)
+			relation["parent"] = parent
+		}
+	}
+	doc[join.Field] = relation
+	return parent, nil
+}
+
+// docRouting resolves the _routing of doc, children of a join default to
+// their parent id so they land on the parent's shard.
+func docRouting(doc map[string]any, routingField, parent string) (string, error) {
+	if routingField == "" {
+		return parent, nil
+	}
+	value, ok := utils.Lookup(doc, routingField)
+	if !ok || value == nil {
+		return "", fmt.Errorf("document missing routing field %q", routingField)
+	}
+	return idString(value), nil
+}
@@ -0,0 +1,54 @@
+package es
+
+import (
+	"mongo-es/utils"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestApplyJoin(t *testing.T) {
+	parentID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
+	join := utils.JoinConf{Field: "relation", NameField: "type", ParentField: "question_id"}
+
+	child := map[string]any{"type": "answer", "question_id": parentID}
+	parent, err := applyJoin(child, join)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent != "507f1f77bcf86cd799439011" {
+		t.Fatalf("got parent %s", parent)
+	}
+	want := map[string]any{"name": "answer", "parent": "507f1f77bcf86cd799439011"}
+	if !reflect.DeepEqual(child["relation"], want) {
+		t.Fatalf("got %v want %v", child["relation"], want)
+	}
+
+	question := map[string]any{"type": "question"}
+	if parent, err := applyJoin(question, join); err != nil || parent != "" {
+		t.Fatalf("unexpected parent=%q err=%v", parent, err)
+	}
+	if !reflect.DeepEqual(question["relation"], map[string]any{"name": "question"}) {
+		t.Fatalf("got %v", question["relation"])
+	}
+
+	if _, err := applyJoin(map[string]any{}, join); err == nil {
+		t.Fatal("expected error for missing name field")
+	}
+}
+
+func TestDocRouting(t *testing.T) {
+	if routing, _ := docRouting(map[string]any{}, "", ""); routing != "" {
+		t.Fatalf("expected no routing, got %s", routing)
+	}
+	if routing, _ := docRouting(map[string]any{}, "", "p1"); routing != "p1" {
+		t.Fatalf("expected parent routing, got %s", routing)
+	}
+	if routing, _ := docRouting(map[string]any{"tenant_id": int32(7)}, "tenant_id", "p1"); routing != "7" {
+		t.Fatalf("expected tenant routing, got %s", routing)
+	}
+	if _, err := docRouting(map[string]any{}, "tenant_id", ""); err == nil {
+		t.Fatal("expected error for missing routing field")
+	}
+}
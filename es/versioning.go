@@ -0,0 +1,86 @@
+package es
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"mongo-es/utils"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type clusterTimeKey struct{}
+type collectionKey struct{}
+
+// ContextWithClusterTime attaches the Mongo operation time of the batch being
+// indexed, used by the cluster_time versioning source.
+func ContextWithClusterTime(ctx context.Context, ts primitive.Timestamp) context.Context {
+	return context.WithValue(ctx, clusterTimeKey{}, ts)
+}
+
+func clusterTimeFromContext(ctx context.Context) primitive.Timestamp {
+	ts, _ := ctx.Value(clusterTimeKey{}).(primitive.Timestamp)
+	return ts
+}
+
+// ContextWithCollection attaches the collection the batch was read from, used
+// to label bulk metrics.
+func ContextWithCollection(ctx context.Context, coll string) context.Context {
+	return context.WithValue(ctx, collectionKey{}, coll)
+}
+
+func collectionFromContext(ctx context.Context) string {
+	coll, _ := ctx.Value(collectionKey{}).(string)
+	return coll
+}
+
+func validateVersioning(prefix string, versioning utils.VersioningConf) error {
+	switch versioning.Type {
+	case "external", "external_gte":
+	default:
+		return fmt.Errorf("unknown version type %q for %s", versioning.Type, prefix)
+	}
+	switch versioning.Source {
+	case "field", "cluster_time", "updated_at":
+	default:
+		return fmt.Errorf("unknown version source %q for %s", versioning.Source, prefix)
+	}
+	return nil
+}
+
+func docVersion(doc map[string]any, versioning utils.VersioningConf, clusterTime primitive.Timestamp) (int64, error) {
+	value, _ := utils.Lookup(doc, versioning.Field)
+	switch versioning.Source {
+	case "cluster_time":
+		if clusterTime.IsZero() {
+			return 0, fmt.Errorf("no cluster time for batch, cluster_time versioning needs a replica set")
+		}
+		return int64(clusterTime.T)<<32 | int64(clusterTime.I), nil
+	case "updated_at":
+		t, ok := toTime(value)
+		if !ok {
+			return 0, fmt.Errorf("document missing version date field %q", versioning.Field)
+		}
+		return t.UnixMilli(), nil
+	}
+	switch v := value.(type) {
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case float64:
+		if v == math.Trunc(v) {
+			return int64(v), nil
+		}
+	case string:
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n, nil
+		}
+	case nil:
+		return 0, fmt.Errorf("document missing version field %q", versioning.Field)
+	}
+	return 0, fmt.Errorf("version field %q is not an integer: %v", versioning.Field, value)
+}
@@ -0,0 +1,66 @@
+package es
+
+import (
+	"context"
+	"mongo-es/utils"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDocVersion(t *testing.T) {
+	updated := time.Date(2025, 8, 21, 14, 51, 43, 0, time.UTC)
+	cases := []struct {
+		name       string
+		versioning utils.VersioningConf
+		doc        map[string]any
+		ts         primitive.Timestamp
+		want       int64
+	}{
+		{"int field", utils.VersioningConf{Source: "field", Field: "version"}, map[string]any{"version": int32(3)}, primitive.Timestamp{}, 3},
+		{"float field", utils.VersioningConf{Source: "field", Field: "version"}, map[string]any{"version": 4.0}, primitive.Timestamp{}, 4},
+		{"updated_at", utils.VersioningConf{Source: "updated_at", Field: "updated_at"}, map[string]any{"updated_at": primitive.NewDateTimeFromTime(updated)}, primitive.Timestamp{}, updated.UnixMilli()},
+		{"cluster time", utils.VersioningConf{Source: "cluster_time"}, map[string]any{}, primitive.Timestamp{T: 2, I: 5}, 2<<32 | 5},
+	}
+	for _, c := range cases {
+		got, err := docVersion(c.doc, c.versioning, c.ts)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got != c.want {
+			t.Errorf("%s: expected %d, got %d", c.name, c.want, got)
+		}
+	}
+
+	if _, err := docVersion(map[string]any{}, utils.VersioningConf{Source: "field", Field: "version"}, primitive.Timestamp{}); err == nil {
+		t.Error("expected error for missing version field")
+	}
+	if _, err := docVersion(map[string]any{"version": 1.5}, utils.VersioningConf{Source: "field", Field: "version"}, primitive.Timestamp{}); err == nil {
+		t.Error("expected error for fractional version")
+	}
+	if _, err := docVersion(map[string]any{}, utils.VersioningConf{Source: "cluster_time"}, primitive.Timestamp{}); err == nil {
+		t.Error("expected error without cluster time")
+	}
+}
+
+func TestClusterTimeContext(t *testing.T) {
+	ts := primitive.Timestamp{T: 10, I: 1}
+	if got := clusterTimeFromContext(ContextWithClusterTime(context.Background(), ts)); !got.Equal(ts) {
+		t.Fatalf("got %v want %v", got, ts)
+	}
+	if got := clusterTimeFromContext(context.Background()); !got.IsZero() {
+		t.Fatalf("expected zero timestamp, got %v", got)
+	}
+}
+
+func TestValidateVersioning(t *testing.T) {
+	versioning, _ := (&utils.ElasticConf{Versioning: map[string]utils.VersioningConf{"users": {}}}).GetVersioning("users")
+	if err := validateVersioning("users", versioning); err != nil {
+		t.Fatal(err)
+	}
+	versioning.Type = "internal"
+	if err := validateVersioning("users", versioning); err == nil {
+		t.Fatal("expected error for internal versioning")
+	}
+}
@@ -0,0 +1,109 @@
+// Package health runs the liveness and readiness checks served on /healthz and
+// /readyz.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type check struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// Report is the outcome of a set of checks, Checks holds "ok" or the error of
+// every check.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+type Health struct {
+	live    []check
+	ready   []check
+	timeout time.Duration
+}
+
+// New creates checks that fail when they take longer than timeout.
+func New(timeout time.Duration) *Health {
+	return &Health{timeout: timeout}
+}
+
+// Live adds a check that fails /healthz, the process is restarted when it
+// keeps failing.
+func (h *Health) Live(name string, fn func(context.Context) error) {
+	h.live = append(h.live, check{name: name, fn: fn})
+}
+
+// Ready adds a check that fails /readyz, the syncer is taken out of rotation
+// while it fails.
+func (h *Health) Ready(name string, fn func(context.Context) error) {
+	h.ready = append(h.ready, check{name: name, fn: fn})
+}
+
+func (h *Health) LiveHandler() http.Handler {
+	return h.handler(func() []check { return h.live })
+}
+
+// ReadyHandler runs the liveness checks too, a stalled syncer is not ready.
+func (h *Health) ReadyHandler() http.Handler {
+	return h.handler(func() []check { return append(append([]check{}, h.live...), h.ready...) })
+}
+
+func (h *Health) handler(checks func() []check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := h.run(r.Context(), checks())
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(data)
+		w.Write([]byte("\n"))
+	})
+}
+
+// run runs checks concurrently, a check that ignores its context is reported
+// as timed out instead of blocking the probe.
+func (h *Health) run(ctx context.Context, checks []check) Report {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(checks))
+	for _, c := range checks {
+		go func() {
+			results <- result{name: c.name, err: c.fn(ctx)}
+		}()
+	}
+	report := Report{Status: "ok", Checks: make(map[string]string, len(checks))}
+	for range checks {
+		select {
+		case res := <-results:
+			report.Checks[res.name] = "ok"
+			if res.err != nil {
+				report.Checks[res.name] = res.err.Error()
+				report.Status = "failing"
+			}
+		case <-ctx.Done():
+			for _, c := range checks {
+				if _, ok := report.Checks[c.name]; !ok {
+					report.Checks[c.name] = fmt.Sprintf("timed out after %s", h.timeout)
+				}
+			}
+			report.Status = "failing"
+			return report
+		}
+	}
+	return report
+}
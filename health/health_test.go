@@ -0,0 +1,49 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, handler http.Handler) (int, Report) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var report Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, report
+}
+
+func TestHandlers(t *testing.T) {
+	h := New(50 * time.Millisecond)
+	h.Live("watches", func(context.Context) error { return nil })
+	h.Ready("mongo", func(context.Context) error { return nil })
+	h.Ready("elastic", func(context.Context) error { return errors.New("connection refused") })
+	h.Ready("lag", func(ctx context.Context) error {
+		<-make(chan struct{})
+		return nil
+	})
+
+	code, report := get(t, h.LiveHandler())
+	if code != http.StatusOK || !reflect.DeepEqual(report, Report{Status: "ok", Checks: map[string]string{"watches": "ok"}}) {
+		t.Fatalf("healthz: got %d %v", code, report)
+	}
+	code, report = get(t, h.ReadyHandler())
+	want := Report{Status: "failing", Checks: map[string]string{
+		"watches": "ok",
+		"mongo":   "ok",
+		"elastic": "connection refused",
+		"lag":     "timed out after 50ms",
+	}}
+	if code != http.StatusServiceUnavailable || !reflect.DeepEqual(report, want) {
+		t.Fatalf("readyz: got %d %v", code, report)
+	}
+}
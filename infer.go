@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"mongo-es/es"
+	"mongo-es/md"
+	"mongo-es/utils"
+)
+
+func runInfer(ctx context.Context, cfg *utils.Conf, args []string) error {
+	fs := flag.NewFlagSet("infer", flag.ExitOnError)
+	size := fs.Int("size", 1000, "number of documents to sample per collection")
+	out := fs.String("out", cfg.Elastic.TemplatesDir, "directory to write index templates to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	colls := fs.Args()
+	if len(colls) == 0 {
+		colls = cfg.Mongo.WhiteList
+	}
+	if len(colls) == 0 {
+		return fmt.Errorf("no collections to infer, pass them as arguments or set mongo.white_list")
+	}
+
+	utils.Prepare()
+	mc := md.NewMdClient(cfg)
+	if err := mc.Init(ctx); err != nil {
+		return err
+	}
+	defer mc.Destroy(ctx)
+	mapper, err := utils.NewMapper()
+	if err != nil {
+		return fmt.Errorf("failed to create mapper: %s", err.Error())
+	}
+
+	for _, coll := range colls {
+		prefixes := cfg.Elastic.GetCollTargets(coll)
+		mc.SetProjection(coll, mapper.Projection(coll, prefixes...))
+		sampled, err := mc.SampleColl(ctx, cfg.Mongo.DB, coll, *size)
+		if err != nil {
+			return err
+		}
+		for _, prefix := range prefixes {
+			esProcessedMap, err := mapper.Map(coll, prefix, sampled)
+			if err != nil {
+				return err
+			}
+			inference := es.NewInference()
+			for _, doc := range esProcessedMap {
+				inference.Add(doc)
+			}
+			file, err := es.WriteTemplate(*out, prefix, es.IndexTemplate(prefix, inference))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("inferred %s from %d %s documents into %s\n", prefix, len(sampled), coll, file)
+			for _, conflict := range inference.Conflicts() {
+				fmt.Printf("  conflict %s\n", conflict)
+			}
+		}
+	}
+	return nil
+}
@@ -3,91 +3,288 @@ package main
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"mongo-es/drift"
 	"mongo-es/es"
+	"mongo-es/health"
 	"mongo-es/md"
+	"mongo-es/metrics"
+	"mongo-es/server"
+	"mongo-es/tracing"
 	"mongo-es/utils"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
 	ctx := context.Background()
 	cfg, err := utils.NewConf()
 	if err != nil {
-		fmt.Println(err.Error())
-		os.Exit(1)
+		fatal("failed to load config", "error", err)
+	}
+	if err := utils.SetupLogging(cfg.Log, os.Stdout); err != nil {
+		fatal("invalid log config", "error", err)
+	}
+	shutdownTracing, err = tracing.Setup(ctx, cfg.Tracing, os.Stdout)
+	if err != nil {
+		fatal("invalid tracing config", "error", err)
+	}
+	defer shutdownTracing(ctx)
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, cfg, os.Args[1], os.Args[2:]); err != nil {
+			fatal("command failed", "command", os.Args[1], "error", err)
+		}
+		return
 	}
 	utils.Prepare()
 	mc := md.NewMdClient(cfg)
 	esc := es.NewEsClient(cfg)
 	if err := esc.Init(); err != nil {
-		fmt.Printf("%s\n", err.Error())
-		os.Exit(1)
+		fatal("failed to init elastic", "error", err)
+	}
+	if err := esc.PutTemplates(ctx); err != nil {
+		fatal("failed to put index templates", "error", err)
 	}
-	fmt.Println("elastic initialized")
+	if err := esc.BootstrapRollover(ctx); err != nil {
+		fatal("failed to bootstrap rollover", "error", err)
+	}
+	slog.Info("elastic initialized")
 	if err := mc.Init(ctx); err != nil {
-		fmt.Printf("%s\n", err.Error())
-		os.Exit(1)
+		fatal("failed to init mongo", "error", err)
 	}
-	fmt.Println("mongodb initialized.")
+	slog.Info("mongodb initialized")
 	db := cfg.Mongo.DB
 	colls, err := mc.Colls(ctx, db)
 	if err != nil {
-		fmt.Printf("failed to get %s collections %s\n", db, err.Error())
-		os.Exit(1)
+		fatal("failed to list collections", "db", db, "error", err)
 	}
 	mapper, err := utils.NewMapper()
 	if err != nil {
-		fmt.Printf("failed to create mapper: %s\n", err.Error())
-		os.Exit(1)
+		fatal("failed to create mapper", "error", err)
+	}
+
+	if !cfg.Coverage.Disabled {
+		go logCoverage(mapper, cfg.Coverage.GetLogInterval(), cfg.Coverage.GetTop())
+	}
+	go logLag(mc, cfg.Lag.GetLogInterval(), cfg.Lag.GetWarnAfter())
+	if !cfg.HTTP.Disabled {
+		srv := server.New(cfg.HTTP.GetAddr())
+		srv.Handle("/coverage", server.JSON(func() any { return mapper.Coverage() }))
+		srv.Handle("/metrics", metrics.Handler())
+		srv.Handle("/lag", server.JSON(func() any { return mc.Lags() }))
+		checks := healthChecks(cfg, mc, esc)
+		srv.Handle("/healthz", checks.LiveHandler())
+		srv.Handle("/readyz", checks.ReadyHandler())
+		if err := srv.Start(); err != nil {
+			fatal("failed to start http server", "error", err)
+		}
+	}
+
+	var tracker *drift.Tracker
+	if !cfg.Drift.Disabled {
+		drift.Dir = cfg.Drift.GetDir()
+		tracker = drift.NewTracker(cfg.Drift.GetVanishAfter())
+		flushDrift = tracker.Flush
 	}
 
 	for _, coll := range colls {
 		if !cfg.Mongo.IsWhiteListed(coll) {
-			fmt.Printf("ignoring %s\n", coll)
+			slog.Info("ignoring collection", "collection", coll)
 			continue
 		}
-		go func() {
-			if err != nil {
-				fmt.Printf("failed to get batch size: %s", err.Error())
-				return
+		prefixes := cfg.Elastic.GetCollTargets(coll)
+		mc.SetProjection(coll, mapper.Projection(coll, prefixes...))
+		if err := scanPII(ctx, cfg, mc, mapper, coll); err != nil {
+			slog.Error("failed to scan for personal data", "collection", coll, "error", err)
+		}
+		plans := make(map[string]*utils.RawPlan, len(prefixes))
+		for _, prefix := range prefixes {
+			if plan, ok := mapper.RawPlan(coll, prefix); ok && esc.CanIndexRaw(prefix) {
+				plans[prefix] = plan
 			}
+		}
+		go func() {
 			prCh, errCh, err := mc.WatchColl(ctx, db, coll, "")
 			if err != nil {
-				fmt.Printf("failed to get %s changes: %s", coll, err.Error())
+				slog.Error("failed to watch collection", "collection", coll, "error", err)
 				return
 			}
+			// indexBatch stops at the first failure, a batch is checkpointed only
+			// once every target was mapped and indexed
+			indexBatch := func(processed md.Batch) error {
+				batchCtx := es.ContextWithCollection(es.ContextWithClusterTime(processed.Context(ctx), processed.ClusterTime), coll)
+				targets := make([]es.Target, 0, len(prefixes))
+				for _, prefix := range prefixes {
+					if plan, ok := plans[prefix]; ok {
+						if tracker != nil {
+							tracker.ObserveRenamed(coll, prefix, processed.Docs, plan.IndexedName)
+						}
+						targets = append(targets, es.Target{Prefix: prefix, Raws: processed.Docs, Plan: plan})
+						metrics.DocsMapped.WithLabelValues(coll, prefix).Add(float64(len(processed.Docs)))
+						continue
+					}
+					esProcessedMap, err := mapper.MapContext(batchCtx, coll, prefix, processed.Docs)
+					if err != nil {
+						return err
+					}
+					if tracker != nil {
+						tracker.ObserveIndex(coll, prefix, esProcessedMap)
+					}
+					targets = append(targets, es.Target{Prefix: prefix, Docs: esProcessedMap})
+					metrics.DocsMapped.WithLabelValues(coll, prefix).Add(float64(len(esProcessedMap)))
+				}
+				return esc.IndexTargets(batchCtx, targets)
+			}
 			for {
 				select {
 				case processed, ok := <-prCh:
 					if !ok {
-						fmt.Printf("Channel closed for collection %s, stopping processing", coll)
+						slog.Info("channel closed, stopping processing", "collection", coll)
 						return
 					}
-					prefix := cfg.Elastic.GetCollPrefix(coll)
-					if !ok {
-						prefix = coll
-					}
-					processedMap, err := mapper.ProcessedMapper(coll, processed)
-					if err != nil {
-						errCh <- err
+					metrics.QueueDepth.WithLabelValues(coll).Set(float64(len(prCh)))
+					if tracker != nil {
+						tracker.ObserveSource(coll, processed.Docs)
 					}
-					esProcessedMap, err := mapper.EsMapper(prefix, processedMap)
+					err := indexBatch(processed)
+					utils.EndSpan(processed.Span, err)
 					if err != nil {
-						errCh <- err
+						fatal("failed to sync collection", "collection", coll, "error", err)
 					}
-					if err := esc.IndexProcessed(ctx, esProcessedMap, prefix); err != nil {
-						errCh <- err
+					if err := mc.Checkpoint(coll, processed); err != nil {
+						fatal("failed to checkpoint collection", "collection", coll, "error", err)
 					}
 				case err, ok := <-errCh:
 					if !ok {
-						fmt.Printf("Channel closed for collection %s, stopping processing", coll)
+						slog.Info("channel closed, stopping processing", "collection", coll)
 						return
 					}
-					fmt.Printf("failed to get %s changes: %s", coll, err.Error())
-					os.Exit(1)
+					fatal("failed to sync collection", "collection", coll, "error", err)
 				}
 			}
 		}()
 	}
-	select {}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	slog.Info("shutting down", "signal", (<-stop).String())
+	if err := flushDrift(); err != nil {
+		slog.Error("failed to save drift state", "error", err)
+	}
+}
+
+func runCommand(ctx context.Context, cfg *utils.Conf, cmd string, args []string) error {
+	switch cmd {
+	case "infer":
+		return runInfer(ctx, cfg, args)
+	case "reindex":
+		return runReindex(ctx, cfg, args)
+	case "drift":
+		return runDrift(cfg, args)
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// scanPII samples coll and warns about fields that look like personal data
+// but are indexed without a privacy step.
+func scanPII(ctx context.Context, cfg *utils.Conf, mc *md.MdClient, mapper *utils.Mapper, coll string) error {
+	if cfg.Mongo.PIIScan <= 0 {
+		return nil
+	}
+	sampled, err := mc.SampleColl(ctx, cfg.Mongo.DB, coll, cfg.Mongo.PIIScan)
+	if err != nil {
+		return err
+	}
+	findings, err := mapper.PIIScan(coll, sampled)
+	if err != nil {
+		return err
+	}
+	for _, finding := range findings {
+		slog.Warn("field looks like personal data and has no privacy rule", "collection", coll, "field", finding.Field, "kind", finding.Kind)
+	}
+	return nil
+}
+
+// healthChecks reports the syncer stalled when a watched collection stopped
+// polling, a poller blocks on a full queue when indexing hangs, and not ready
+// when a client is unreachable or a collection is too far behind.
+func healthChecks(cfg *utils.Conf, mc *md.MdClient, esc *es.EsClient) *health.Health {
+	checks := health.New(cfg.Health.GetTimeout())
+	stallAfter := cfg.Health.GetStallAfter()
+	checks.Live("watches", func(context.Context) error {
+		stalled := []string{}
+		for coll, watch := range mc.Watches() {
+			if time.Since(watch.LastPoll) > stallAfter {
+				stalled = append(stalled, coll)
+			}
+		}
+		if len(stalled) > 0 {
+			sort.Strings(stalled)
+			return fmt.Errorf("no poll for %s: %s", stallAfter, strings.Join(stalled, ", "))
+		}
+		return nil
+	})
+	checks.Ready("mongo", mc.Ping)
+	checks.Ready("elastic", esc.Ping)
+	maxLag := cfg.Health.GetMaxLag()
+	checks.Ready("lag", func(context.Context) error {
+		behind := []string{}
+		for coll, watch := range mc.Watches() {
+			switch {
+			case watch.Lag < 0:
+				behind = append(behind, coll+" not polled yet")
+			case watch.Lag > maxLag:
+				behind = append(behind, fmt.Sprintf("%s %d docs behind", coll, watch.Lag))
+			}
+		}
+		if len(behind) > 0 {
+			sort.Strings(behind)
+			return fmt.Errorf("%s", strings.Join(behind, ", "))
+		}
+		return nil
+	})
+	return checks
+}
+
+// shutdownTracing flushes pending spans, set once tracing is configured.
+var shutdownTracing = func(context.Context) error { return nil }
+
+// flushDrift saves the observed schemas, set once drift tracking is enabled.
+var flushDrift = func() error { return nil }
+
+// fatal logs a failure the syncer cannot go on after and exits, the observed
+// schemas and the spans of the failed batch are flushed first.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	if err := flushDrift(); err != nil {
+		slog.Error("failed to save drift state", "error", err)
+	}
+	shutdownTracing(context.Background())
+	os.Exit(1)
+}
+
+// logLag logs the replication lag of every collection each interval, as a
+// warning once it exceeds warnAfter.
+func logLag(mc *md.MdClient, interval, warnAfter time.Duration) {
+	for range time.Tick(interval) {
+		for _, lag := range mc.Lags() {
+			if lag.Lag > warnAfter {
+				slog.Warn("replication lag above threshold", "collection", lag.Collection, "lag", lag.Lag, "threshold", warnAfter)
+				continue
+			}
+			slog.Info("replication lag", "collection", lag.Collection, "lag", lag.Lag)
+		}
+	}
+}
+
+// logCoverage prints a mapping coverage summary every interval.
+func logCoverage(mapper *utils.Mapper, interval time.Duration, top int) {
+	for range time.Tick(interval) {
+		for _, line := range mapper.CoverageSummary(top) {
+			slog.Info("mapping coverage", "summary", line)
+		}
+	}
 }
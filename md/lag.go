@@ -0,0 +1,170 @@
+package md
+
+import (
+	"context"
+	"fmt"
+	"mongo-es/metrics"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Lag is how far the index of a collection is behind its newest source event.
+type Lag struct {
+	Collection string    `json:"collection"`
+	Newest     time.Time `json:"newest"`
+	// Checkpoint is the newest event covered by the indexed batches
+	Checkpoint time.Time     `json:"checkpoint"`
+	Lag        time.Duration `json:"-"`
+	Seconds    float64       `json:"lag_seconds"`
+}
+
+type lagState struct {
+	newest     time.Time
+	checkpoint time.Time
+	count      int64
+	indexed    int64
+}
+
+// eventTime reads the time of an event out of a sortBy value, ObjectIDs
+// carry their creation time.
+func eventTime(value bson.RawValue) (time.Time, bool) {
+	switch value.Type {
+	case bson.TypeDateTime:
+		return value.Time(), true
+	case bson.TypeTimestamp:
+		t, _ := value.Timestamp()
+		return time.Unix(int64(t), 0), true
+	case bson.TypeObjectID:
+		return value.ObjectID().Timestamp(), true
+	}
+	return time.Time{}, false
+}
+
+// batchCheckpoint returns the greatest sortBy time of docs, zero when none
+// carries one.
+func batchCheckpoint(docs []bson.Raw, sortBy string) time.Time {
+	var newest time.Time
+	for _, doc := range docs {
+		value, err := doc.LookupErr(sortBy)
+		if err != nil {
+			continue
+		}
+		if t, ok := eventTime(value); ok && t.After(newest) {
+			newest = t
+		}
+	}
+	return newest
+}
+
+// newestEvent returns the newest event of coll, the cluster time of the last
+// read when there is one, its greatest sortBy value otherwise.
+func newestEvent(ctx context.Context, coll *mongo.Collection, sortBy string, clusterTime primitive.Timestamp) (time.Time, error) {
+	if !clusterTime.IsZero() {
+		return time.Unix(int64(clusterTime.T), 0), nil
+	}
+	opts := options.FindOne().SetSort(bson.D{{Key: sortBy, Value: -1}}).SetProjection(bson.D{{Key: sortBy, Value: 1}})
+	raw, err := coll.FindOne(ctx, bson.D{}, opts).Raw()
+	if err == mongo.ErrNoDocuments {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read newest %s of %s: %w", sortBy, coll.Name(), err)
+	}
+	value, err := raw.LookupErr(sortBy)
+	if err != nil {
+		return time.Time{}, nil
+	}
+	t, _ := eventTime(value)
+	return t, nil
+}
+
+// observePoll records the document count and newest event of coll seen by a
+// poll, independently of what was indexed.
+func (m *MdClient) observePoll(coll string, count int64, newest time.Time) {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	state := m.lag(coll)
+	state.count = count
+	if newest.After(state.newest) {
+		state.newest = newest
+	}
+	setLagGauge(coll, state)
+}
+
+// indexed records that batch was indexed.
+func (m *MdClient) indexed(coll string, batch Batch) {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	state := m.lag(coll)
+	state.indexed = max(state.indexed, batch.Offset)
+	if batch.Checkpoint.After(state.checkpoint) {
+		state.checkpoint = batch.Checkpoint
+	}
+	setLagGauge(coll, state)
+}
+
+func (m *MdClient) startLag(coll string, offset int64) {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	state := m.lag(coll)
+	state.indexed = max(state.indexed, offset)
+}
+
+func (m *MdClient) lag(coll string) *lagState {
+	state, ok := m.lags[coll]
+	if !ok {
+		state = &lagState{}
+		m.lags[coll] = state
+	}
+	return state
+}
+
+// known reports whether the lag can be measured, a backlog has none until its
+// first batch carrying a sortBy time is indexed.
+func (s *lagState) known() bool {
+	return !s.newest.IsZero() && (s.caughtUp() || !s.checkpoint.IsZero())
+}
+
+func (s *lagState) caughtUp() bool {
+	return s.indexed >= s.count
+}
+
+func (s *lagState) lag() time.Duration {
+	if s.caughtUp() {
+		return 0
+	}
+	return max(s.newest.Sub(s.checkpoint), 0)
+}
+
+func setLagGauge(coll string, state *lagState) {
+	if state.known() {
+		metrics.ReplicationLag.WithLabelValues(coll).Set(state.lag().Seconds())
+	}
+}
+
+// Lags returns the replication lag of every polled collection whose
+// documents carry a sortBy time.
+func (m *MdClient) Lags() []Lag {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	lags := make([]Lag, 0, len(m.lags))
+	for coll, state := range m.lags {
+		if !state.known() {
+			continue
+		}
+		lags = append(lags, Lag{
+			Collection: coll,
+			Newest:     state.newest,
+			Checkpoint: state.checkpoint,
+			Lag:        state.lag(),
+			Seconds:    state.lag().Seconds(),
+		})
+	}
+	sort.Slice(lags, func(i, j int) bool { return lags[i].Collection < lags[j].Collection })
+	return lags
+}
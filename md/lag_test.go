@@ -0,0 +1,118 @@
+package md
+
+import (
+	"context"
+	"mongo-es/utils"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestEventTime(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, value := range []any{
+		primitive.NewDateTimeFromTime(at),
+		primitive.Timestamp{T: uint32(at.Unix())},
+		primitive.NewObjectIDFromTimestamp(at),
+	} {
+		raw, err := bson.Marshal(bson.D{{Key: "v", Value: value}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := eventTime(bson.Raw(raw).Lookup("v"))
+		if !ok || !got.Equal(at) {
+			t.Errorf("%T: got %v %v", value, got, ok)
+		}
+	}
+	raw, _ := bson.Marshal(bson.D{{Key: "v", Value: "yesterday"}})
+	if _, ok := eventTime(bson.Raw(raw).Lookup("v")); ok {
+		t.Error("strings carry no event time")
+	}
+}
+
+func TestBatchCheckpoint(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	docs := []bson.Raw{}
+	for _, value := range []any{primitive.NewDateTimeFromTime(at.Add(-time.Hour)), primitive.NewDateTimeFromTime(at), "not a time"} {
+		raw, err := bson.Marshal(bson.D{{Key: "created_at", Value: value}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, raw)
+	}
+	if got := batchCheckpoint(docs, "created_at"); !got.Equal(at) {
+		t.Errorf("got %v want %v", got, at)
+	}
+	if got := batchCheckpoint(docs, "missing"); !got.IsZero() {
+		t.Errorf("expected no checkpoint, got %v", got)
+	}
+}
+
+func TestLagBacklog(t *testing.T) {
+	m := NewMdClient(&utils.Conf{})
+	newest := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	m.startLag("users", 0)
+	m.observePoll("users", 30, newest)
+	if lags := m.Lags(); len(lags) != 0 {
+		t.Fatalf("backlogs have no lag before their first indexed batch, got %v", lags)
+	}
+	expectLag := func(want time.Duration) {
+		t.Helper()
+		lags := m.Lags()
+		if len(lags) != 1 || lags[0].Lag != want {
+			t.Fatalf("expected lag %s, got %v", want, lags)
+		}
+	}
+
+	// 30 documents read newest first in pages of 10, the newest indexed
+	// event stays the checkpoint while older pages are indexed
+	m.Checkpoint("users", Batch{Offset: 10, Checkpoint: newest.Add(-2 * time.Hour)})
+	expectLag(2 * time.Hour)
+	m.Checkpoint("users", Batch{Offset: 20, Checkpoint: newest.Add(-20 * time.Hour)})
+	expectLag(2 * time.Hour)
+	m.Checkpoint("users", Batch{Offset: 30, Checkpoint: newest.Add(-40 * time.Hour)})
+	expectLag(0)
+
+	// a new event is measured from the checkpoint until its batch is indexed
+	m.observePoll("users", 31, newest.Add(5*time.Minute))
+	expectLag(2*time.Hour + 5*time.Minute)
+	m.Checkpoint("users", Batch{Offset: 31, Checkpoint: newest.Add(4 * time.Minute)})
+	expectLag(0)
+	if lags := m.Lags(); !lags[0].Checkpoint.Equal(newest.Add(4 * time.Minute)) {
+		t.Errorf("unexpected checkpoint %v", lags[0].Checkpoint)
+	}
+}
+
+func TestCheckpointFailedBatch(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.MkdirAll("processed/md-processed", 0755); err != nil {
+		t.Fatal(err)
+	}
+	batch := func(ids ...string) []bson.Raw {
+		docs := []bson.Raw{}
+		for _, id := range ids {
+			raw, err := bson.Marshal(bson.D{{Key: "_id", Value: id}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			docs = append(docs, raw)
+		}
+		return docs
+	}
+	m := NewMdClient(&utils.Conf{})
+	if err := m.Checkpoint("users", Batch{Docs: batch("a", "b"), Offset: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// the next batch failed to index and is never checkpointed
+
+	restarted := NewMdClient(&utils.Conf{})
+	if err := restarted.loadOffsets(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.collStat["users"].Offset; got != 2 {
+		t.Fatalf("expected the failed batch to be read again from offset 2, got %d", got)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"log/slog"
+	"maps"
+	"mongo-es/metrics"
 	"mongo-es/utils"
 	"os"
 	"path"
@@ -13,24 +16,68 @@ import (
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type WatchEvent struct {
 	Collection string
 	DB         string
 }
+type Batch struct {
+	Docs []bson.Raw
+	// ClusterTime is the operation time of the read, zero on standalone servers
+	ClusterTime primitive.Timestamp
+	// Span is the trace of the batch, WatchColl leaves ending it to the
+	// consumer once the batch is indexed
+	Span trace.Span
+	// Offset is the offset of the collection once the batch is indexed
+	Offset int64
+	// Checkpoint is the newest sortBy time of Docs, zero when they carry none
+	Checkpoint time.Time
+}
+
+// Context returns ctx carrying the trace of the batch, spans of the mapping
+// and indexing stages join it.
+func (b Batch) Context(ctx context.Context) context.Context {
+	if b.Span == nil {
+		return ctx
+	}
+	return trace.ContextWithSpan(ctx, b.Span)
+}
+
+var tracer = otel.Tracer("mongo-es/md")
+
 type CollStats struct {
 	Offset int64
 }
+
+// WatchStat is the progress of a watched collection, Lag is -1 until the
+// first poll counted the collection.
+type WatchStat struct {
+	LastPoll time.Time
+	Lag      int64
+}
+
 type MdClient struct {
 	cfg          *utils.Conf
 	cl           *mongo.Client
 	watchChan    chan WatchEvent
 	collStat     map[string]CollStats
 	processFiles map[string]*os.File
+	filesMu      sync.Mutex
+	projections  map[string]bson.D
+	projMu       sync.RWMutex
 	mu           sync.Mutex
+	// watches and lags have their own lock so health checks never wait on a poll
+	watches map[string]WatchStat
+	lags    map[string]*lagState
+	watchMu sync.Mutex
 }
 
 func NewMdClient(cfg *utils.Conf) *MdClient {
@@ -39,7 +86,10 @@ func NewMdClient(cfg *utils.Conf) *MdClient {
 		watchChan:    make(chan WatchEvent, 1000),
 		collStat:     make(map[string]CollStats),
 		processFiles: make(map[string]*os.File),
+		projections:  make(map[string]bson.D),
 		mu:           sync.Mutex{},
+		watches:      make(map[string]WatchStat),
+		lags:         make(map[string]*lagState),
 	}
 }
 func (m *MdClient) Init(ctx context.Context) error {
@@ -88,18 +138,125 @@ func (m *MdClient) loadOffsets(ctx context.Context) error {
 	return nil
 }
 
+// Ping checks that the primary is reachable.
+func (m *MdClient) Ping(ctx context.Context) error {
+	if m.cl == nil {
+		return fmt.Errorf("mongo client not initialized")
+	}
+	return m.cl.Ping(ctx, readpref.Primary())
+}
+
+// Watches returns the progress of the collections being watched.
+func (m *MdClient) Watches() map[string]WatchStat {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	return maps.Clone(m.watches)
+}
+
+func (m *MdClient) setWatch(coll string, lag int64) {
+	m.watchMu.Lock()
+	defer m.watchMu.Unlock()
+	m.watches[coll] = WatchStat{LastPoll: time.Now(), Lag: lag}
+}
+
 func (m *MdClient) Destroy(ctx context.Context) error {
 	return m.cl.Disconnect(ctx)
 }
 func (m *MdClient) Colls(ctx context.Context, db string) ([]string, error) {
 	return m.cl.Database(db).ListCollectionNames(ctx, bson.D{})
 }
-func (m *MdClient) WatchColl(ctx context.Context, db, coll, sortBy string) (chan []bson.Raw, chan error, error) {
+func (m *MdClient) SetProjection(coll string, projection bson.D) {
+	m.projMu.Lock()
+	defer m.projMu.Unlock()
+	m.projections[coll] = projection
+}
+func (m *MdClient) projection(coll string) bson.D {
+	m.projMu.RLock()
+	defer m.projMu.RUnlock()
+	return m.projections[coll]
+}
+func (m *MdClient) SampleColl(ctx context.Context, db, coll string, size int) ([]bson.Raw, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$sample", Value: bson.D{{Key: "size", Value: size}}}},
+	}
+	if projection := m.projection(coll); projection != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: projection}})
+	}
+	cur, err := m.cl.Database(db).Collection(coll).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample %s: %s", coll, err.Error())
+	}
+	defer cur.Close(ctx)
+	sampled := []bson.Raw{}
+	for cur.Next(ctx) {
+		sampled = append(sampled, append(bson.Raw(nil), cur.Current...))
+	}
+	if err := cur.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s samples: %s", coll, err.Error())
+	}
+	return sampled, nil
+}
+func (m *MdClient) ScanColl(ctx context.Context, db, coll string, fn func(Batch) error) (int, error) {
+	sess, err := m.cl.StartSession()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start %s session: %s", coll, err.Error())
+	}
+	defer sess.EndSession(ctx)
+	sc := mongo.NewSessionContext(ctx, sess)
+
+	batchSize := m.cfg.Mongo.GetCollBatch(coll)
+	findOpts := options.Find().SetBatchSize(batchSize)
+	if projection := m.projection(coll); projection != nil {
+		findOpts.SetProjection(projection)
+	}
+	cur, err := m.cl.Database(db).Collection(coll).Find(sc, bson.D{}, findOpts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to scan %s: %s", coll, err.Error())
+	}
+	defer cur.Close(sc)
+	scanned := 0
+	flush := func(docs []bson.Raw) error {
+		_, span := tracer.Start(ctx, "reindex.batch", trace.WithNewRoot(), trace.WithAttributes(
+			attribute.String("collection", coll), attribute.Int("docs", len(docs))))
+		batch := Batch{Docs: docs, Span: span}
+		if opTime := sess.OperationTime(); opTime != nil {
+			batch.ClusterTime = *opTime
+		}
+		err := fn(batch)
+		utils.EndSpan(span, err)
+		if err != nil {
+			return err
+		}
+		scanned += len(docs)
+		return nil
+	}
+	docs := make([]bson.Raw, 0, batchSize)
+	for cur.Next(sc) {
+		docs = append(docs, append(bson.Raw(nil), cur.Current...))
+		if len(docs) < int(batchSize) {
+			continue
+		}
+		if err := flush(docs); err != nil {
+			return scanned, err
+		}
+		docs = make([]bson.Raw, 0, batchSize)
+	}
+	if err := cur.Err(); err != nil {
+		return scanned, fmt.Errorf("failed to scan %s: %s", coll, err.Error())
+	}
+	if len(docs) > 0 {
+		if err := flush(docs); err != nil {
+			return scanned, err
+		}
+	}
+	return scanned, nil
+}
+func (m *MdClient) WatchColl(ctx context.Context, db, coll, sortBy string) (chan Batch, chan error, error) {
 	if sortBy == "" {
 		sortBy = "created_at"
 	}
 	var stat CollStats
-	processedChan := make(chan []bson.Raw, 10)
+	processedChan := make(chan Batch, 10)
 	errorChan := make(chan error, 1)
 
 	collStat, ok := m.collStat[coll]
@@ -113,17 +270,25 @@ func (m *MdClient) WatchColl(ctx context.Context, db, coll, sortBy string) (chan
 	} else {
 		stat = collStat
 	}
+	m.setWatch(coll, -1)
+	m.startLag(coll, stat.Offset)
 	go func() {
 		defer close(processedChan)
 		defer close(errorChan)
+		defer func() {
+			m.watchMu.Lock()
+			delete(m.watches, coll)
+			m.watchMu.Unlock()
+		}()
 
 		for {
 			select {
 			case <-ctx.Done():
-				fmt.Println("watch coll ctx done")
+				slog.Info("stopped watching", "collection", coll, "error", ctx.Err())
 				return
 			default:
 			}
+			pollStart := time.Now()
 			targetColl := m.cl.Database(db).Collection(coll)
 			docCount, err := targetColl.CountDocuments(ctx, bson.D{})
 			if err != nil {
@@ -131,37 +296,79 @@ func (m *MdClient) WatchColl(ctx context.Context, db, coll, sortBy string) (chan
 				return
 			}
 			if docCount == collStat.Offset {
-				fmt.Printf("%s processed count reached max of %d\n", coll, collStat.Offset)
+				metrics.CheckpointLag.WithLabelValues(coll).Set(0)
+				slog.Info("processed every document", "collection", coll, "offset", collStat.Offset)
 				return
 			}
 			allowDiskUse := true
 			batchSize := m.cfg.Mongo.GetCollBatch(coll)
 			limit := int64(batchSize)
-			cur, err := targetColl.Find(ctx, bson.D{}, &options.FindOptions{Sort: bson.M{sortBy: -1}, Skip: &stat.Offset, Limit: &limit, BatchSize: &batchSize, AllowDiskUse: &allowDiskUse})
+			sess, err := m.cl.StartSession()
 			if err != nil {
-				errorChan <- fmt.Errorf("failed to skip %d items from %s in %s database: %s", stat.Offset, coll, db, err.Error())
+				errorChan <- fmt.Errorf("failed to start %s session: %s", coll, err.Error())
 				return
 			}
-
+			batchCtx, span := tracer.Start(ctx, "sync.batch", trace.WithNewRoot(), trace.WithAttributes(
+				attribute.String("collection", coll), attribute.Int64("offset", stat.Offset)))
+			findCtx, findSpan := tracer.Start(batchCtx, "mongo.find", trace.WithAttributes(
+				attribute.String("collection", coll), attribute.Int64("limit", limit)))
 			processed := []bson.Raw{}
-			for cur.Next(ctx) {
-				item := cur.Current
-				processed = append(processed, item)
+			err = mongo.WithSession(findCtx, sess, func(sc mongo.SessionContext) error {
+				findOpts := &options.FindOptions{Sort: bson.M{sortBy: -1}, Skip: &stat.Offset, Limit: &limit, BatchSize: &batchSize, AllowDiskUse: &allowDiskUse}
+				if projection := m.projection(coll); projection != nil {
+					findOpts.SetProjection(projection)
+				}
+				cur, err := targetColl.Find(sc, bson.D{}, findOpts)
+				if err != nil {
+					return err
+				}
+				defer cur.Close(sc)
+				for cur.Next(sc) {
+					item := cur.Current
+					processed = append(processed, item)
+				}
+				return cur.Err()
+			})
+			var clusterTime primitive.Timestamp
+			if opTime := sess.OperationTime(); opTime != nil {
+				clusterTime = *opTime
 			}
-			cur.Close(ctx)
+			sess.EndSession(ctx)
+			findSpan.SetAttributes(attribute.Int("docs", len(processed)))
+			utils.EndSpan(findSpan, err)
+			if err != nil {
+				utils.EndSpan(span, err)
+				errorChan <- fmt.Errorf("failed to skip %d items from %s in %s database: %s", stat.Offset, coll, db, err.Error())
+				return
+			}
+			span.SetAttributes(attribute.Int("docs", len(processed)))
+			if newest, err := newestEvent(ctx, targetColl, sortBy, clusterTime); err != nil {
+				slog.Warn("failed to measure replication lag", "collection", coll, "error", err)
+			} else {
+				m.observePoll(coll, docCount, newest)
+			}
+
+			took := time.Since(pollStart)
+			metrics.PollDuration.WithLabelValues(coll).Observe(took.Seconds())
+			slog.Debug("polled collection", "collection", coll, "batch_size", len(processed), "offset", stat.Offset, "duration", took)
+			metrics.DocsRead.WithLabelValues(coll).Add(float64(len(processed)))
 
 			atomic.AddInt64(&stat.Offset, int64(len(processed)))
+			metrics.CheckpointLag.WithLabelValues(coll).Set(float64(max(docCount-stat.Offset, 0)))
+			m.setWatch(coll, max(docCount-stat.Offset, 0))
 			m.mu.Lock()
 			m.collStat[coll] = stat
-			processedChan <- processed
 			m.mu.Unlock()
-
-			if len(processed) > 0 {
-				if err := m.logProcessed(coll, processed); err != nil {
-					errorChan <- err
-					return
-				}
+			batch := Batch{Docs: processed, ClusterTime: clusterTime, Span: span, Offset: stat.Offset, Checkpoint: batchCheckpoint(processed, sortBy)}
+			select {
+			case processedChan <- batch:
+			case <-ctx.Done():
+				span.End()
+				slog.Info("stopped watching", "collection", coll, "error", ctx.Err())
+				return
 			}
+			metrics.QueueDepth.WithLabelValues(coll).Set(float64(len(processedChan)))
+
 			processSleepTimeout := m.cfg.Mongo.BatchTimeoutSec
 			time.Sleep(time.Duration(processSleepTimeout) * time.Second)
 		}
@@ -170,7 +377,22 @@ func (m *MdClient) WatchColl(ctx context.Context, db, coll, sortBy string) (chan
 	return processedChan, errorChan, nil
 }
 
+// Checkpoint records that batch was indexed, call it once the bulk request
+// succeeded. Its documents are logged as processed only then, so a batch that
+// failed is read again after a restart.
+func (m *MdClient) Checkpoint(coll string, batch Batch) error {
+	if len(batch.Docs) > 0 {
+		if err := m.logProcessed(coll, batch.Docs); err != nil {
+			return err
+		}
+	}
+	m.indexed(coll, batch)
+	return nil
+}
+
 func (m *MdClient) logProcessed(coll string, processed []bson.Raw) error {
+	m.filesMu.Lock()
+	defer m.filesMu.Unlock()
 	file, ok := m.processFiles[coll]
 	if !ok {
 		f, err := os.OpenFile(path.Join("processed/md-processed", fmt.Sprintf("%s_processed.log", coll)), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0655)
@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/brianvoe/gofakeit/v6"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -95,6 +96,26 @@ func TestColls(t *testing.T) {
 	fmt.Printf("colls: %v\n", colls)
 }
 
+func TestProjectionWhilePolling(t *testing.T) {
+	m := NewMdClient(&utils.Conf{})
+	// a poll holds mu while it updates the offsets
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	done := make(chan bson.D)
+	go func() {
+		m.SetProjection("users", bson.D{{Key: "name", Value: 1}})
+		done <- m.projection("users")
+	}()
+	select {
+	case got := <-done:
+		if len(got) != 1 || got[0].Key != "name" {
+			t.Fatalf("unexpected projection %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("projection blocked on the poll lock")
+	}
+}
+
 func generateTestRecord(ctx context.Context, count int) ([]any, error) {
 	records := make([]any, 0)
 	for range count {
@@ -0,0 +1,84 @@
+// Package metrics holds the Prometheus collectors of the syncer, served on
+// /metrics.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "mongoes"
+
+var (
+	DocsRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "documents_read_total",
+		Help:      "Documents read from Mongo.",
+	}, []string{"collection"})
+	DocsMapped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "documents_mapped_total",
+		Help:      "Documents mapped for an index prefix.",
+	}, []string{"collection", "index"})
+	DocsIndexed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "documents_indexed_total",
+		Help:      "Documents accepted by Elasticsearch.",
+	}, []string{"collection"})
+	DocsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "documents_failed_total",
+		Help:      "Documents rejected by Elasticsearch or lost with a failed bulk request.",
+	}, []string{"collection"})
+	BulkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bulk_duration_seconds",
+		Help:      "Duration of bulk requests.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"collection"})
+	BulkBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "bulk_size_bytes",
+		Help:      "Size of bulk request bodies.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"collection"})
+	Retries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "elastic_retries_total",
+		Help:      "Requests to Elasticsearch retried by the client.",
+	})
+	QueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Batches read from Mongo waiting to be indexed.",
+	}, []string{"collection"})
+	CheckpointLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "checkpoint_lag_documents",
+		Help:      "Documents in the collection past the processed offset.",
+	}, []string{"collection"})
+	ReplicationLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "replication_lag_seconds",
+		Help:      "Time between the newest source event and the newest indexed one.",
+	}, []string{"collection"})
+	PollDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mongo_poll_duration_seconds",
+		Help:      "Duration of Mongo polls, counting documents and reading the batch.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"collection"})
+)
+
+func init() {
+	prometheus.MustRegister(DocsRead, DocsMapped, DocsIndexed, DocsFailed, BulkDuration, BulkBytes,
+		Retries, QueueDepth, CheckpointLag, ReplicationLag, PollDuration)
+}
+
+// Handler serves the registered collectors along with the Go runtime and
+// process ones.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	DocsRead.WithLabelValues("users").Add(3)
+	BulkDuration.WithLabelValues("users").Observe(0.2)
+	QueueDepth.WithLabelValues("users").Set(2)
+
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+	res, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`mongoes_documents_read_total{collection="users"} 3`,
+		`mongoes_bulk_duration_seconds_count{collection="users"} 1`,
+		`mongoes_queue_depth{collection="users"} 2`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"mongo-es/es"
+	"mongo-es/md"
+	"mongo-es/utils"
+	"time"
+)
+
+func runReindex(ctx context.Context, cfg *utils.Conf, args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	deleteOld := fs.Bool("delete-old", false, "delete the previous indices after the alias swap")
+	target := fs.String("index", "", "index to rebuild when the collection feeds several")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: reindex [-delete-old] [-index name] <collection>")
+	}
+	coll := fs.Arg(0)
+	prefix, err := reindexTarget(cfg.Elastic.GetCollTargets(coll), *target)
+	if err != nil {
+		return fmt.Errorf("%s: %w", coll, err)
+	}
+	alias, ok := cfg.Elastic.GetReadAlias(prefix)
+	if !ok {
+		return fmt.Errorf("set elastic.read_alias for %s to reindex it", prefix)
+	}
+
+	utils.Prepare()
+	mc := md.NewMdClient(cfg)
+	if err := mc.Init(ctx); err != nil {
+		return err
+	}
+	defer mc.Destroy(ctx)
+	esc := es.NewEsClient(cfg)
+	if err := esc.Init(); err != nil {
+		return err
+	}
+	mapper, err := utils.NewMapper()
+	if err != nil {
+		return fmt.Errorf("failed to create mapper: %s", err.Error())
+	}
+
+	mc.SetProjection(coll, mapper.Projection(coll, prefix))
+	// fail before the backfill rather than at the swap
+	if _, err := esc.CheckAliasIndex(ctx, alias, *deleteOld); err != nil {
+		return err
+	}
+	index := es.VersionedIndex(prefix, time.Now())
+	if err := esc.CreateIndex(ctx, index); err != nil {
+		return err
+	}
+	if err := esc.StartDualWrite(prefix, index); err != nil {
+		return err
+	}
+	defer esc.StopDualWrite(prefix)
+	start := time.Now()
+	slog.Info("backfilling, live changes are dual-written", "collection", coll, "index", index)
+
+	count, err := mc.ScanColl(ctx, cfg.Mongo.DB, coll, func(batch md.Batch) error {
+		batchCtx := es.ContextWithCollection(es.ContextWithClusterTime(batch.Context(ctx), batch.ClusterTime), coll)
+		esProcessedMap, err := mapper.MapContext(batchCtx, coll, prefix, batch.Docs)
+		if err != nil {
+			return err
+		}
+		return esc.IndexInto(batchCtx, esProcessedMap, prefix, index)
+	})
+	if err != nil {
+		return fmt.Errorf("backfill of %s failed after %d documents: %w", index, count, err)
+	}
+	slog.Info("backfilled", "collection", coll, "index", index, "docs", count, "duration", time.Since(start))
+
+	old, err := esc.SwapAlias(ctx, alias, index, *deleteOld)
+	if err != nil {
+		return err
+	}
+	if *deleteOld {
+		return esc.DeleteIndices(ctx, old)
+	}
+	return nil
+}
+
+// reindexTarget picks the index to rebuild among the ones a collection feeds.
+func reindexTarget(prefixes []string, want string) (string, error) {
+	if want == "" {
+		if len(prefixes) > 1 {
+			return "", fmt.Errorf("feeds %v, pick one with -index", prefixes)
+		}
+		return prefixes[0], nil
+	}
+	for _, prefix := range prefixes {
+		if prefix == want {
+			return prefix, nil
+		}
+	}
+	return "", fmt.Errorf("does not feed %s", want)
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	rec := httptest.NewRecorder()
+	JSON(func() any { return map[string]int{"docs": 2} }).ServeHTTP(rec, httptest.NewRequest("GET", "/coverage", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("got content type %s", ct)
+	}
+	if body := rec.Body.String(); body != "{\n  \"docs\": 2\n}\n" {
+		t.Fatalf("got body %q", body)
+	}
+}
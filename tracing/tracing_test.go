@@ -0,0 +1,38 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"mongo-es/utils"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetup(t *testing.T) {
+	ctx := context.Background()
+	if _, err := Setup(ctx, utils.TracingConf{Exporter: "zipkin"}, nil); err == nil {
+		t.Fatal("expected error for unknown exporter")
+	}
+	shutdown, err := Setup(ctx, utils.TracingConf{}, nil)
+	if err != nil || shutdown(ctx) != nil {
+		t.Fatalf("disabled tracing failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	shutdown, err = Setup(ctx, utils.TracingConf{Exporter: "stdout", ServiceName: "syncer"}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := otel.Tracer("test").Start(ctx, "sync.batch")
+	span.End()
+	if err := shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"Name":"sync.batch"`, `"Value":"syncer"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %s in %s", want, buf.String())
+		}
+	}
+}
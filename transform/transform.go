@@ -0,0 +1,85 @@
+// Package transform lets custom builds of the syncer plug Go code into the
+// mapping pipeline. Transformers register themselves from an init function
+// and are enabled per index in mappings.yaml.
+package transform
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Meta describes where a document comes from and which index it goes to.
+type Meta struct {
+	Collection string
+	Index      string
+}
+
+// Transformer receives a document after every mapping ran and returns the
+// documents to index instead, none to skip it or several to split it.
+type Transformer interface {
+	Transform(meta Meta, doc map[string]any) ([]map[string]any, error)
+}
+
+// Func adapts a function to Transformer.
+type Func func(meta Meta, doc map[string]any) ([]map[string]any, error)
+
+func (f Func) Transform(meta Meta, doc map[string]any) ([]map[string]any, error) {
+	return f(meta, doc)
+}
+
+var (
+	mu       sync.RWMutex
+	registry = map[string]Transformer{}
+)
+
+// Register makes a transformer available under name. It panics when the
+// name is taken, like database/sql drivers.
+func Register(name string, t Transformer) {
+	mu.Lock()
+	defer mu.Unlock()
+	if t == nil {
+		panic("transform: Register transformer is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic(fmt.Sprintf("transform: Register called twice for %s", name))
+	}
+	registry[name] = t
+}
+
+func Get(name string) (Transformer, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	t, ok := registry[name]
+	return t, ok
+}
+
+// Names lists the registered transformers.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Chain runs transformers in order, every document returned by one is passed
+// to the next.
+func Chain(meta Meta, doc map[string]any, transformers []Transformer) ([]map[string]any, error) {
+	docs := []map[string]any{doc}
+	for _, t := range transformers {
+		next := []map[string]any{}
+		for _, doc := range docs {
+			out, err := t.Transform(meta, doc)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, out...)
+		}
+		docs = next
+	}
+	return docs, nil
+}
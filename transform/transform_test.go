@@ -0,0 +1,48 @@
+package transform
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	split := Func(func(meta Meta, doc map[string]any) ([]map[string]any, error) {
+		out := []map[string]any{}
+		for _, tag := range doc["tags"].([]any) {
+			out = append(out, map[string]any{"tag": tag, "index": meta.Index})
+		}
+		return out, nil
+	})
+	Register("test_split", split)
+	if _, ok := Get("test_split"); !ok {
+		t.Fatal("expected registered transformer")
+	}
+	if _, ok := Get("missing"); ok {
+		t.Fatal("expected missing transformer")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic on duplicate registration")
+		}
+	}()
+	Register("test_split", split)
+}
+
+func TestChain(t *testing.T) {
+	split := Func(func(meta Meta, doc map[string]any) ([]map[string]any, error) {
+		return []map[string]any{{"n": doc["n"]}, {"n": doc["n"].(int) + 1}}, nil
+	})
+	dropOdd := Func(func(meta Meta, doc map[string]any) ([]map[string]any, error) {
+		if doc["n"].(int)%2 == 1 {
+			return nil, nil
+		}
+		return []map[string]any{doc}, nil
+	})
+	got, err := Chain(Meta{}, map[string]any{"n": 1}, []Transformer{split, dropOdd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []map[string]any{{"n": 2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
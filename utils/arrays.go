@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/go-viper/mapstructure/v2"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	ArrayNested   = "nested"
+	ArrayParallel = "parallel"
+	ArrayFirst    = "first"
+	ArrayLast     = "last"
+	ArrayCount    = "count"
+)
+
+// arrayRule maps an array field with its strategy, rules run against every
+// element of the array.
+type arrayRule struct {
+	field    string
+	strategy string
+	rules    []rule
+}
+
+// compileArrays turns the arrays section of an index into rules keyed by
+// field. Options are found under the dotted parts of their field name.
+func compileArrays(section map[string]any) (map[string]arrayRule, error) {
+	arrays := map[string]arrayRule{}
+	if err := collectArrays("", section, arrays); err != nil {
+		return nil, err
+	}
+	return arrays, nil
+}
+
+func collectArrays(prefix string, section map[string]any, arrays map[string]arrayRule) error {
+	for key, value := range section {
+		field := key
+		if prefix != "" {
+			field = prefix + "." + key
+		}
+		opts, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("invalid array options for %s: %v", field, value)
+		}
+		_, hasStrategy := opts["strategy"]
+		_, hasFields := opts["fields"]
+		if !hasStrategy && !hasFields {
+			if err := collectArrays(field, opts, arrays); err != nil {
+				return err
+			}
+			continue
+		}
+		var conf ArrayOptions
+		if err := mapstructure.Decode(opts, &conf); err != nil {
+			return fmt.Errorf("invalid array options for %s: %w", field, err)
+		}
+		switch conf.Strategy {
+		case "":
+			conf.Strategy = ArrayNested
+		case ArrayNested, ArrayParallel, ArrayFirst, ArrayLast, ArrayCount:
+		default:
+			return fmt.Errorf("unknown array strategy %q for %s", conf.Strategy, field)
+		}
+		rules, err := compileRules(conf.Fields)
+		if err != nil {
+			return fmt.Errorf("invalid element mapping for %s: %w", field, err)
+		}
+		arrays[field] = arrayRule{field: field, strategy: conf.Strategy, rules: rules}
+	}
+	return nil
+}
+
+// apply replaces the array in the flattened doc according to the strategy.
+func (a arrayRule) apply(doc map[string]any, shape string) error {
+	items, ok := asSlice(doc[a.field])
+	if !ok {
+		return nil
+	}
+	if a.strategy == ArrayCount {
+		doc[a.field] = len(items)
+		return nil
+	}
+	switch a.strategy {
+	case ArrayFirst:
+		items = items[:min(len(items), 1)]
+	case ArrayLast:
+		items = items[max(len(items)-1, 0):]
+	}
+	mapped := make([]any, 0, len(items))
+	for _, item := range items {
+		elem, ok := asMap(item)
+		if !ok {
+			mapped = append(mapped, item)
+			continue
+		}
+		flattened := make(map[string]any, len(elem))
+		flatten("", elem, flattened)
+		out, err := applyRules(flattened, a.rules, keepAll, nil)
+		if err != nil {
+			return fmt.Errorf("%s: %w", a.field, err)
+		}
+		if a.strategy == ArrayNested {
+			var paths map[string][]string
+			if shape == ShapeOriginal {
+				paths = make(map[string][]string, len(flattened))
+				fieldPaths(nil, elem, paths)
+			}
+			out = shapeDoc(out, shape, paths)
+		}
+		mapped = append(mapped, out)
+	}
+
+	switch a.strategy {
+	case ArrayNested:
+		doc[a.field] = mapped
+	case ArrayParallel:
+		delete(doc, a.field)
+		for _, item := range mapped {
+			if elem, ok := item.(map[string]any); ok {
+				for k, v := range elem {
+					key := a.field + "." + k
+					values, _ := doc[key].([]any)
+					doc[key] = append(values, v)
+				}
+			}
+		}
+	case ArrayFirst, ArrayLast:
+		delete(doc, a.field)
+		if len(mapped) == 0 {
+			return nil
+		}
+		elem, ok := mapped[0].(map[string]any)
+		if !ok {
+			doc[a.field] = mapped[0]
+			return nil
+		}
+		for k, v := range elem {
+			doc[a.field+"."+k] = v
+		}
+	}
+	return nil
+}
+
+func asSlice(v any) ([]any, bool) {
+	switch items := v.(type) {
+	case bson.A:
+		return items, true
+	case []any:
+		return items, true
+	}
+	return nil, false
+}
+
+func asMap(v any) (map[string]any, bool) {
+	switch m := v.(type) {
+	case map[string]any:
+		return m, true
+	case bson.M:
+		return m, true
+	case bson.D:
+		return m.Map(), true
+	}
+	return nil, false
+}
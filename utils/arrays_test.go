@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestArrayStrategies(t *testing.T) {
+	raw, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: "o1"},
+		{Key: "items", Value: bson.A{
+			bson.D{{Key: "sku", Value: "a"}, {Key: "qty", Value: int32(1)}, {Key: "dim", Value: bson.D{{Key: "w", Value: int32(2)}}}},
+			bson.D{{Key: "sku", Value: "b"}, {Key: "qty", Value: int32(3)}, {Key: "dim", Value: bson.D{{Key: "w", Value: int32(4)}}}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[string]any{"sku": "product", "dim": map[string]any{"w": "width"}}
+	cases := []struct {
+		strategy string
+		shape    string
+		want     map[string]any
+	}{
+		{ArrayNested, "", map[string]any{"_id": "o1", "items": []any{
+			map[string]any{"product": "a", "qty": int32(1), "width": int32(2)},
+			map[string]any{"product": "b", "qty": int32(3), "width": int32(4)},
+		}}},
+		{ArrayParallel, "", map[string]any{
+			"_id":           "o1",
+			"items.product": []any{"a", "b"},
+			"items.qty":     []any{int32(1), int32(3)},
+			"items.width":   []any{int32(2), int32(4)},
+		}},
+		{ArrayFirst, "", map[string]any{"_id": "o1", "items.product": "a", "items.qty": int32(1), "items.width": int32(2)}},
+		{ArrayLast, ShapeNested, map[string]any{"_id": "o1", "items": map[string]any{"product": "b", "qty": int32(3), "width": int32(4)}}},
+		{ArrayCount, "", map[string]any{"_id": "o1", "items": 2}},
+	}
+	for _, c := range cases {
+		m, err := newMapper(&Mappings{
+			Indices: map[string]IndexOptions{"order_index": {
+				Mode:   ModePassthrough,
+				Shape:  c.shape,
+				Arrays: map[string]any{"items": map[string]any{"strategy": c.strategy, "fields": fields}},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		processed, err := m.ProcessedMapper("orders", []bson.Raw{raw})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := m.EsMapper("order_index", processed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got[0], c.want) {
+			t.Errorf("%s:\n got %#v\nwant %#v", c.strategy, got[0], c.want)
+		}
+	}
+}
+
+func TestCompileArrays(t *testing.T) {
+	arrays, err := compileArrays(map[string]any{
+		"order": map[string]any{"items": map[string]any{"strategy": "count"}},
+		"tags":  map[string]any{"fields": map[string]any{"name": "tag"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arrays["order.items"].strategy != ArrayCount || arrays["tags"].strategy != ArrayNested {
+		t.Errorf("unexpected arrays %v", arrays)
+	}
+	if _, err := compileArrays(map[string]any{"items": map[string]any{"strategy": "zip"}}); err == nil {
+		t.Error("expected error for unknown strategy")
+	}
+}
@@ -0,0 +1,336 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/casbin/govaluate"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// computedField is a field added to mapped documents from an expression.
+type computedField struct {
+	name string
+	expr *govaluate.EvaluableExpression
+}
+
+// compileComputed parses the expressions of a collection, nested keys are
+// joined with dots like mapping rules.
+func compileComputed(section map[string]any) ([]computedField, error) {
+	fields := []computedField{}
+	if err := collectComputed("", section, &fields); err != nil {
+		return nil, err
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+	return fields, nil
+}
+
+func collectComputed(prefix string, section map[string]any, fields *[]computedField) error {
+	for key, value := range section {
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case string:
+			expr, err := govaluate.NewEvaluableExpressionWithFunctions(v, exprFunctions)
+			if err == nil {
+				err = checkOperators(expr)
+			}
+			if err != nil {
+				return fmt.Errorf("invalid expression for %s: %w", name, err)
+			}
+			*fields = append(*fields, computedField{name: name, expr: expr})
+		case map[string]any:
+			if err := collectComputed(name, v, fields); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("invalid expression for %s: %v", name, value)
+		}
+	}
+	return nil
+}
+
+// checkOperators refuses operands following each other without an operator,
+// govaluate parses them and silently evaluates only one.
+func checkOperators(expr *govaluate.EvaluableExpression) error {
+	operand := false
+	for _, token := range expr.Tokens() {
+		switch token.Kind {
+		case govaluate.NUMERIC, govaluate.BOOLEAN, govaluate.STRING, govaluate.PATTERN, govaluate.TIME,
+			govaluate.VARIABLE, govaluate.ACCESSOR, govaluate.FUNCTION, govaluate.CLAUSE:
+			if operand {
+				return fmt.Errorf("missing operator before %v", token.Value)
+			}
+		}
+		switch token.Kind {
+		case govaluate.NUMERIC, govaluate.BOOLEAN, govaluate.STRING, govaluate.PATTERN, govaluate.TIME,
+			govaluate.VARIABLE, govaluate.ACCESSOR, govaluate.CLAUSE_CLOSE:
+			operand = true
+		default:
+			operand = false
+		}
+	}
+	return nil
+}
+
+// inputs lists the document fields the expression reads.
+func (c computedField) inputs() []string {
+	return c.expr.Vars()
+}
+
+// compute evaluates every field against doc before setting any of them, so
+// computed fields never see each other.
+func compute(doc map[string]any, fields []computedField) error {
+	values := make([]any, len(fields))
+	for i, field := range fields {
+		value, err := field.eval(doc)
+		if err != nil {
+			return fmt.Errorf("failed to compute %s: %w", field.name, err)
+		}
+		if list, ok := value.(exprList); ok {
+			value = []any(list)
+		}
+		values[i] = value
+	}
+	for i, field := range fields {
+		if values[i] == nil {
+			continue
+		}
+		setPath(doc, strings.Split(field.name, "."), values[i])
+	}
+	return nil
+}
+
+// eval turns a panic of the evaluator into an error, so a bad expression
+// fails the batch instead of the process.
+func (c computedField) eval(doc map[string]any) (value any, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return c.expr.Eval(exprParams{doc})
+}
+
+// exprParams resolves expression variables from a mapped document. Missing
+// fields are nil so they can be handled with the ?? operator.
+type exprParams struct {
+	doc map[string]any
+}
+
+func (p exprParams) Get(name string) (any, error) {
+	value, ok := Lookup(p.doc, name)
+	if !ok {
+		value = lookupArray(p.doc, name)
+	}
+	return exprValue(value), nil
+}
+
+// lookupArray collects field from every element of an array of objects
+// along the path, so sum([orders.total]) works.
+func lookupArray(doc map[string]any, field string) any {
+	for i := strings.IndexByte(field, '.'); i > 0; i = nextDot(field, i) {
+		value, ok := Lookup(doc, field[:i])
+		if !ok {
+			continue
+		}
+		items, ok := asSlice(value)
+		if !ok {
+			return nil
+		}
+		values := []any{}
+		for _, item := range items {
+			if elem, ok := asMap(item); ok {
+				if v, ok := Lookup(elem, field[i+1:]); ok {
+					values = append(values, v)
+				}
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// exprList is an array value, govaluate spreads plain slices passed to a
+// function into separate arguments.
+type exprList []any
+
+// exprValue converts BSON values into the types expressions operate on.
+func exprValue(value any) any {
+	switch v := value.(type) {
+	case primitive.DateTime:
+		return v.Time().UTC()
+	case primitive.Decimal128:
+		f, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			return nil
+		}
+		return f
+	case primitive.ObjectID:
+		return v.Hex()
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	}
+	if items, ok := asSlice(value); ok {
+		out := make(exprList, len(items))
+		for i, item := range items {
+			out[i] = exprValue(item)
+		}
+		return out
+	}
+	return value
+}
+
+var exprFunctions = map[string]govaluate.ExpressionFunction{
+	"now": func(args ...any) (any, error) {
+		return time.Now().UTC(), nil
+	},
+	"age": func(args ...any) (any, error) {
+		t, err := timeArg("age", args)
+		if err != nil || t.IsZero() {
+			return nil, err
+		}
+		now := time.Now().UTC()
+		years := now.Year() - t.Year()
+		if now.Month() < t.Month() || now.Month() == t.Month() && now.Day() < t.Day() {
+			years--
+		}
+		return float64(years), nil
+	},
+	"days_since": func(args ...any) (any, error) {
+		t, err := timeArg("days_since", args)
+		if err != nil || t.IsZero() {
+			return nil, err
+		}
+		return math.Floor(time.Since(t).Hours() / 24), nil
+	},
+	"year": func(args ...any) (any, error) {
+		t, err := timeArg("year", args)
+		if err != nil || t.IsZero() {
+			return nil, err
+		}
+		return float64(t.Year()), nil
+	},
+	"unix": func(args ...any) (any, error) {
+		t, err := timeArg("unix", args)
+		if err != nil || t.IsZero() {
+			return nil, err
+		}
+		return float64(t.Unix()), nil
+	},
+	"lower": stringFunc("lower", strings.ToLower),
+	"upper": stringFunc("upper", strings.ToUpper),
+	"trim":  stringFunc("trim", strings.TrimSpace),
+	"len": func(args ...any) (any, error) {
+		arg, err := singleArg("len", args)
+		if err != nil {
+			return nil, err
+		}
+		switch v := arg.(type) {
+		case string:
+			return float64(len(v)), nil
+		case exprList:
+			return float64(len(v)), nil
+		case nil:
+			return float64(0), nil
+		}
+		return nil, fmt.Errorf("len of %T", arg)
+	},
+	"sum": func(args ...any) (any, error) {
+		total := 0.0
+		for _, arg := range args {
+			items, ok := arg.(exprList)
+			if !ok {
+				items = exprList{arg}
+			}
+			for _, item := range items {
+				switch v := exprValue(item).(type) {
+				case float64:
+					total += v
+				case nil:
+				default:
+					return nil, fmt.Errorf("sum of %T", item)
+				}
+			}
+		}
+		return total, nil
+	},
+	"round": func(args ...any) (any, error) {
+		arg, err := singleArg("round", args)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := arg.(float64)
+		if !ok {
+			return nil, nil
+		}
+		return math.Round(f), nil
+	},
+	"coalesce": func(args ...any) (any, error) {
+		for _, arg := range args {
+			if arg != nil {
+				return arg, nil
+			}
+		}
+		return nil, nil
+	},
+}
+
+// singleArg returns the argument of a one argument function, govaluate calls
+// functions without arguments when the argument is nil.
+func singleArg(name string, args []any) (any, error) {
+	switch len(args) {
+	case 0:
+		return nil, nil
+	case 1:
+		return args[0], nil
+	}
+	return nil, fmt.Errorf("%s takes 1 argument", name)
+}
+
+func timeArg(name string, args []any) (time.Time, error) {
+	arg, err := singleArg(name, args)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch v := arg.(type) {
+	case time.Time:
+		return v, nil
+	case float64:
+		// date literals are unix seconds
+		return time.Unix(int64(v), 0).UTC(), nil
+	case string:
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%s: cannot parse %q as a date", name, v)
+		}
+		return t, nil
+	case nil:
+		return time.Time{}, nil
+	}
+	return time.Time{}, fmt.Errorf("%s of %T", name, arg)
+}
+
+func stringFunc(name string, fn func(string) string) govaluate.ExpressionFunction {
+	return func(args ...any) (any, error) {
+		arg, err := singleArg(name, args)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := arg.(string)
+		if !ok {
+			return arg, nil
+		}
+		return fn(s), nil
+	}
+}
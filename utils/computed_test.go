@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestComputedFields(t *testing.T) {
+	m, err := newMapper(&Mappings{
+		MongoMappings: map[string]map[string]any{"users": {"name": "first_name"}},
+		Computed: map[string]map[string]any{
+			"users": {
+				"full_name": "first_name + ' ' + (last_name ?? '')",
+				"age":       "age(birth_date)",
+				"is_vip":    "sum([orders.total]) > 1000",
+				"stats":     map[string]any{"orders": "len(orders)"},
+				"nickname":  "nickname ?? coalesce(missing)",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	birth := time.Now().UTC().AddDate(-30, 0, -1)
+	raw, err := bson.Marshal(bson.D{
+		{Key: "name", Value: "Alice"},
+		{Key: "birth_date", Value: primitive.NewDateTimeFromTime(birth)},
+		{Key: "orders", Value: bson.A{
+			bson.D{{Key: "total", Value: int32(600)}},
+			bson.D{{Key: "total", Value: 500.5}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := m.ProcessedMapper("users", []bson.Raw{raw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := docs[0]
+	if doc["full_name"] != "Alice " {
+		t.Errorf("full_name = %#v", doc["full_name"])
+	}
+	if doc["age"] != 30.0 {
+		t.Errorf("age = %#v", doc["age"])
+	}
+	if doc["is_vip"] != true {
+		t.Errorf("is_vip = %#v", doc["is_vip"])
+	}
+	if stats, _ := doc["stats"].(map[string]any); stats["orders"] != 2.0 {
+		t.Errorf("stats = %#v", doc["stats"])
+	}
+	if _, ok := doc["nickname"]; ok {
+		t.Errorf("expected nil result to be skipped, got %#v", doc["nickname"])
+	}
+	if _, ok := m.RawPlan("users", "user_index"); ok {
+		t.Error("expected no raw plan with computed fields")
+	}
+}
+
+func TestComputedErrors(t *testing.T) {
+	for _, expr := range []string{"first_name +", "unknown_func(a)", "(a", "(a) (b)", "lower(a) b", "1 2"} {
+		_, err := newMapper(&Mappings{
+			Computed: map[string]map[string]any{"users": {"x": expr}},
+		})
+		if err == nil {
+			t.Errorf("%q: expected compile error", expr)
+		}
+	}
+}
+
+func TestComputedEvalErrors(t *testing.T) {
+	m, err := newMapper(&Mappings{
+		Computed: map[string]map[string]any{"users": {"x": "a > 1 ? 1 : 0", "y": "days_since(now()) + len(b)"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := compute(map[string]any{"a": "x", "b": 1.0}, m.computed["users"]); err == nil {
+		t.Error("expected an error comparing a string")
+	}
+}
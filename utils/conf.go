@@ -5,22 +5,130 @@ import (
 	"fmt"
 	"os"
 	"slices"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Conf struct {
-	Mongo   MongoConf   `mapstructure:"mongo"`
-	Elastic ElasticConf `mapstructure:"elastic"`
+	Mongo    MongoConf    `mapstructure:"mongo"`
+	Elastic  ElasticConf  `mapstructure:"elastic"`
+	Drift    DriftConf    `mapstructure:"drift"`
+	HTTP     HTTPConf     `mapstructure:"http"`
+	Coverage CoverageConf `mapstructure:"coverage"`
+	Health   HealthConf   `mapstructure:"health"`
+	Log      LogConf      `mapstructure:"log"`
+	Tracing  TracingConf  `mapstructure:"tracing"`
+	Lag      LagConf      `mapstructure:"lag"`
+}
+
+type LagConf struct {
+	WarnAfter   int `mapstructure:"warn_after"`
+	LogInterval int `mapstructure:"log_interval"`
+}
+
+type TracingConf struct {
+	// Exporter is otlp, stdout or empty to turn tracing off
+	Exporter    string  `mapstructure:"exporter"`
+	Endpoint    string  `mapstructure:"endpoint"`
+	Insecure    bool    `mapstructure:"insecure"`
+	ServiceName string  `mapstructure:"service_name"`
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+type LogConf struct {
+	Level  string `mapstructure:"level"`
+	Format string `mapstructure:"format"`
+}
+
+type HTTPConf struct {
+	Disabled bool   `mapstructure:"disabled"`
+	Addr     string `mapstructure:"addr"`
+}
+
+type CoverageConf struct {
+	Disabled    bool `mapstructure:"disabled"`
+	LogInterval int  `mapstructure:"log_interval"`
+	Top         int  `mapstructure:"top"`
+}
+
+type HealthConf struct {
+	StallAfter int   `mapstructure:"stall_after"`
+	MaxLag     int64 `mapstructure:"max_lag"`
+	Timeout    int   `mapstructure:"timeout"`
+}
+
+type DriftConf struct {
+	Disabled    bool   `mapstructure:"disabled"`
+	VanishAfter int    `mapstructure:"vanish_after"`
+	Dir         string `mapstructure:"dir"`
 }
 
 type ElasticConf struct {
-	Addresses    []string          `mapstructure:"addresses"`
-	User         string            `mapstructure:"user"`
-	Password     string            `mapstructure:"password"`
-	UniqueFields map[string]string `mapstructure:"unique_fields"`
-	IndicPeriod  map[string]int    `mapstructure:"indic_period"`
-	CollPrefix   map[string]string `mapstructure:"coll_prefix"`
+	Addresses    []string                   `mapstructure:"addresses"`
+	User         string                     `mapstructure:"user"`
+	Password     string                     `mapstructure:"password"`
+	UniqueFields map[string]string          `mapstructure:"unique_fields"`
+	IndicPeriod  map[string]int             `mapstructure:"indic_period"`
+	CollPrefix   map[string][]string        `mapstructure:"coll_prefix"`
+	TemplatesDir string                     `mapstructure:"templates_dir"`
+	ReindexDir   string                     `mapstructure:"reindex_dir"`
+	IndexNaming  map[string]IndexNamingConf `mapstructure:"index_naming"`
+	ILMPolicies  map[string]map[string]any  `mapstructure:"ilm_policies"`
+	Rollover     map[string]RolloverConf    `mapstructure:"rollover"`
+	ReadAliases  map[string]string          `mapstructure:"read_alias"`
+	DocIDs       map[string]DocIDConf       `mapstructure:"doc_id"`
+	Routing      map[string]string          `mapstructure:"routing"`
+	Join         map[string]JoinConf        `mapstructure:"join"`
+	Versioning   map[string]VersioningConf  `mapstructure:"versioning"`
+	Routes       map[string]RoutesConf      `mapstructure:"routes"`
+	Encoding     EncodingConf               `mapstructure:"encoding"`
+}
+type EncodingConf struct {
+	ObjectID string `mapstructure:"object_id"`
+	Decimal  string `mapstructure:"decimal"`
+	Date     string `mapstructure:"date"`
+	Binary   string `mapstructure:"binary"`
+	UUID     string `mapstructure:"uuid"`
+}
+type VersioningConf struct {
+	Type   string `mapstructure:"type"`
+	Source string `mapstructure:"source"`
+	Field  string `mapstructure:"field"`
+}
+type RoutesConf struct {
+	Rules   []RouteRule `mapstructure:"rules"`
+	Default string      `mapstructure:"default"`
+}
+type RouteRule struct {
+	Field  string  `mapstructure:"field"`
+	Equals *string `mapstructure:"equals"`
+	Regex  string  `mapstructure:"regex"`
+	Exists *bool   `mapstructure:"exists"`
+	Index  string  `mapstructure:"index"`
+}
+type JoinConf struct {
+	Field       string `mapstructure:"field"`
+	Name        string `mapstructure:"name"`
+	NameField   string `mapstructure:"name_field"`
+	ParentField string `mapstructure:"parent_field"`
+}
+type DocIDConf struct {
+	Fields    []string `mapstructure:"fields"`
+	Separator string   `mapstructure:"separator"`
+	Hash      string   `mapstructure:"hash"`
+	MaxLen    int      `mapstructure:"max_len"`
+	Missing   string   `mapstructure:"missing"`
+}
+type RolloverConf struct {
+	Alias     string `mapstructure:"alias"`
+	Policy    string `mapstructure:"policy"`
+	Bootstrap bool   `mapstructure:"bootstrap"`
+}
+type IndexNamingConf struct {
+	Strategy  string `mapstructure:"strategy"`
+	Pattern   string `mapstructure:"pattern"`
+	TimeField string `mapstructure:"time_field"`
 }
 type MongoConf struct {
 	CollBatch       map[string]int32 `mapstructure:"coll_batch"`
@@ -28,18 +136,38 @@ type MongoConf struct {
 	URL             string           `mapstructure:"url"`
 	DB              string           `mapstructure:"db"`
 	WhiteList       []string         `mapstructure:"white_list"`
+	PIIScan         int              `mapstructure:"pii_scan"`
 }
 type Mappings struct {
 	MongoMappings   map[string]map[string]any `mapstructure:"mongo"`
 	ElasticMappings map[string]map[string]any `mapstructure:"elastic"`
+	Indices         map[string]IndexOptions   `mapstructure:"indices"`
+	Computed        map[string]map[string]any `mapstructure:"computed"`
+}
+type IndexOptions struct {
+	Mode   string   `mapstructure:"mode"`
+	Fields []string `mapstructure:"fields"`
+	Shape  string   `mapstructure:"shape"`
+	// Arrays holds ArrayOptions per array field, nested under the parts of
+	// dotted field names.
+	Arrays map[string]any `mapstructure:"arrays"`
+	// Transformers are registered Go transformers run in order on every
+	// mapped document.
+	Transformers []string `mapstructure:"transformers"`
+}
+type ArrayOptions struct {
+	Strategy string         `mapstructure:"strategy"`
+	Fields   map[string]any `mapstructure:"fields"`
 }
 
 func newV(name string) (*viper.Viper, error) {
 	mongoDefaultVals := map[string]any{
-		"utl":           "mongodb://localhost:27017",
+		"url":           "mongodb://localhost:27017",
 		"batch_timeout": 10,
 		"db":            "test",
 		"white_list":    []string{},
+		"coll_batch":    make(map[string]int32),
+		"pii_scan":      100,
 	}
 	elasticDefaultVals := map[string]any{
 		"addresses": []string{
@@ -47,7 +175,8 @@ func newV(name string) (*viper.Viper, error) {
 		},
 		"unique_fields": make(map[string]string),
 		"indic_period":  make(map[string]int),
-		"coll_prefix":   make(map[string]string),
+		"coll_prefix":   make(map[string][]string),
+		"templates_dir": "templates",
 	}
 	v := viper.New()
 	v.SetConfigFile(fmt.Sprintf("%s.yaml", name))
@@ -56,10 +185,10 @@ func newV(name string) (*viper.Viper, error) {
 	switch name {
 	case "config":
 		for k, val := range mongoDefaultVals {
-			v.Set(fmt.Sprintf("mongo.%s", k), val)
+			v.SetDefault(fmt.Sprintf("mongo.%s", k), val)
 		}
 		for k, val := range elasticDefaultVals {
-			v.Set(fmt.Sprintf("elastic.%s", k), val)
+			v.SetDefault(fmt.Sprintf("elastic.%s", k), val)
 		}
 	}
 	if err := v.ReadInConfig(); err != nil {
@@ -84,6 +213,7 @@ func NewConf() (*Conf, error) {
 					DB:              "test",
 					CollBatch:       make(map[string]int32),
 					WhiteList:       []string{},
+					PIIScan:         100,
 				},
 				Elastic: ElasticConf{
 					Addresses:    []string{"http://localhost:9200"},
@@ -91,7 +221,8 @@ func NewConf() (*Conf, error) {
 					Password:     "",
 					UniqueFields: make(map[string]string),
 					IndicPeriod:  make(map[string]int),
-					CollPrefix:   make(map[string]string),
+					CollPrefix:   make(map[string][]string),
+					TemplatesDir: "templates",
 				},
 			}
 			return &cfg, nil
@@ -104,6 +235,99 @@ func NewConf() (*Conf, error) {
 	}
 	return &cfg, nil
 }
+
+func (c *HTTPConf) GetAddr() string {
+	if c.Addr != "" {
+		return c.Addr
+	}
+	return ":8080"
+}
+
+// GetLogInterval returns the time between mapping coverage log summaries.
+func (c *CoverageConf) GetLogInterval() time.Duration {
+	if c.LogInterval > 0 {
+		return time.Duration(c.LogInterval) * time.Second
+	}
+	return 5 * time.Minute
+}
+func (c *CoverageConf) GetTop() int {
+	if c.Top > 0 {
+		return c.Top
+	}
+	return 10
+}
+
+// GetStallAfter returns how long a watched collection may go without polling
+// before the syncer is reported as stalled.
+func (c *HealthConf) GetStallAfter() time.Duration {
+	if c.StallAfter > 0 {
+		return time.Duration(c.StallAfter) * time.Second
+	}
+	return 5 * time.Minute
+}
+
+// GetMaxLag returns how many documents a collection may be behind while the
+// syncer is still ready.
+func (c *HealthConf) GetMaxLag() int64 {
+	if c.MaxLag > 0 {
+		return c.MaxLag
+	}
+	return 10000
+}
+
+func (c *HealthConf) GetTimeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return 5 * time.Second
+}
+
+// GetWarnAfter returns the replication lag above which a warning is logged.
+func (c *LagConf) GetWarnAfter() time.Duration {
+	if c.WarnAfter > 0 {
+		return time.Duration(c.WarnAfter) * time.Second
+	}
+	return 5 * time.Minute
+}
+func (c *LagConf) GetLogInterval() time.Duration {
+	if c.LogInterval > 0 {
+		return time.Duration(c.LogInterval) * time.Second
+	}
+	return time.Minute
+}
+
+func (c *TracingConf) GetServiceName() string {
+	if c.ServiceName != "" {
+		return c.ServiceName
+	}
+	return "mongo-es"
+}
+
+// GetSampleRatio returns the share of batches traced, all of them by default.
+func (c *TracingConf) GetSampleRatio() float64 {
+	if c.SampleRatio > 0 && c.SampleRatio < 1 {
+		return c.SampleRatio
+	}
+	return 1
+}
+
+// GetVanishAfter returns how many documents a field may be missing from
+// before it is reported as vanished.
+func (c *DriftConf) GetVanishAfter() int {
+	if c.VanishAfter > 0 {
+		return c.VanishAfter
+	}
+	return 1000
+}
+
+// GetDir returns where observed schemas and baselines are saved, the sync and
+// the drift command must agree on it.
+func (c *DriftConf) GetDir() string {
+	if c.Dir == "" {
+		return "processed/schema"
+	}
+	return c.Dir
+}
 func (c *MongoConf) GetCollBatch(coll string) int32 {
 	if field, exists := c.CollBatch[coll]; exists {
 		return field
@@ -119,17 +343,113 @@ func (c *ElasticConf) GetUniqueField(prefix string) string {
 	}
 	return "_id"
 }
+func (c *ElasticConf) GetDocID(prefix string) DocIDConf {
+	docID := c.DocIDs[prefix]
+	if len(docID.Fields) == 0 {
+		docID.Fields = []string{c.GetUniqueField(prefix)}
+	}
+	if docID.Separator == "" {
+		docID.Separator = ":"
+	}
+	if docID.Hash == "" {
+		docID.Hash = "none"
+	}
+	if docID.MaxLen <= 0 {
+		docID.MaxLen = 512
+	}
+	if docID.Missing == "" {
+		docID.Missing = "error"
+	}
+	return docID
+}
+func (c *ElasticConf) GetRouting(prefix string) string {
+	return c.Routing[prefix]
+}
+func (c *ElasticConf) GetJoin(prefix string) (JoinConf, bool) {
+	join, exists := c.Join[prefix]
+	if !exists {
+		return join, false
+	}
+	if join.Field == "" {
+		join.Field = "relation"
+	}
+	return join, true
+}
+func (c *ElasticConf) GetVersioning(prefix string) (VersioningConf, bool) {
+	versioning, exists := c.Versioning[prefix]
+	if !exists {
+		return versioning, false
+	}
+	if versioning.Type == "" {
+		versioning.Type = "external"
+	}
+	if versioning.Source == "" {
+		versioning.Source = "field"
+	}
+	if versioning.Field == "" {
+		switch versioning.Source {
+		case "field":
+			versioning.Field = "version"
+		case "updated_at":
+			versioning.Field = "updated_at"
+		}
+	}
+	return versioning, true
+}
+func (c *ElasticConf) GetRoutes(prefix string) (RoutesConf, bool) {
+	routes, exists := c.Routes[prefix]
+	if !exists {
+		return routes, false
+	}
+	if routes.Default == "" {
+		routes.Default = prefix
+	}
+	return routes, true
+}
+
+// GetReindexDir returns where running reindexes are recorded, the sync and the
+// reindex command must share it.
+func (c *ElasticConf) GetReindexDir() string {
+	if c.ReindexDir == "" {
+		return "processed/reindex"
+	}
+	return c.ReindexDir
+}
 func (c *ElasticConf) GetIndicPeriod(indic string) int {
 	if field, exists := c.IndicPeriod[indic]; exists {
 		return field
 	}
 	return 24
 }
-func (c *ElasticConf) GetCollPrefix(coll string) string {
-	if field, exists := c.CollPrefix[coll]; exists {
-		return field
+func (c *ElasticConf) GetIndexNaming(prefix string) IndexNamingConf {
+	naming := c.IndexNaming[prefix]
+	if naming.Strategy == "" {
+		naming.Strategy = "period"
+	}
+	return naming
+}
+func (c *ElasticConf) GetRollover(prefix string) (RolloverConf, bool) {
+	rollover, exists := c.Rollover[prefix]
+	if !exists {
+		return rollover, false
+	}
+	if rollover.Alias == "" {
+		rollover.Alias = prefix
+	}
+	return rollover, true
+}
+func (c *ElasticConf) GetReadAlias(prefix string) (string, bool) {
+	alias, exists := c.ReadAliases[prefix]
+	return alias, exists && alias != ""
+}
+
+// GetCollTargets returns the indices a collection feeds, coll_prefix takes a
+// single index or a list of them.
+func (c *ElasticConf) GetCollTargets(coll string) []string {
+	if targets, exists := c.CollPrefix[coll]; exists && len(targets) > 0 {
+		return targets
 	}
-	return coll
+	return []string{coll}
 }
 func LoadMappings() (*Mappings, error) {
 	v, err := newV("mappings")
@@ -115,3 +115,36 @@ func TestNewConfNoConfigFile(t *testing.T) {
 	assert.NotNil(t, cfg.Elastic.IndicPeriod)
 	assert.NotNil(t, cfg.Elastic.CollPrefix)
 }
+
+func TestCollTargets(t *testing.T) {
+	var originalExists bool
+	_, err := os.ReadFile("config.yaml")
+	if err == nil {
+		originalExists = true
+		err = os.Rename("config.yaml", "config.yaml.bak")
+		assert.NoError(t, err)
+	}
+
+	configContent := `elastic:
+  coll_prefix:
+    users: user_index
+    orders:
+      - orders
+      - orders_search
+`
+	err = os.WriteFile("config.yaml", []byte(configContent), 0644)
+	assert.NoError(t, err)
+
+	defer func() {
+		os.Remove("config.yaml")
+		if originalExists {
+			os.Rename("config.yaml.bak", "config.yaml")
+		}
+	}()
+
+	cfg, err := NewConf()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user_index"}, cfg.Elastic.GetCollTargets("users"))
+	assert.Equal(t, []string{"orders", "orders_search"}, cfg.Elastic.GetCollTargets("orders"))
+	assert.Equal(t, []string{"events"}, cfg.Elastic.GetCollTargets("events"))
+}
@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxUnmapped bounds the unmapped fields tracked per section, documents with
+// dynamic keys would grow the counters forever.
+const maxUnmapped = 1000
+
+const otherFields = "(other)"
+
+// CoverageSection counts how often the rules of a mappings section were
+// applied and how often fields without a rule went through it.
+type CoverageSection struct {
+	Section  string           `json:"section"`
+	Docs     int64            `json:"docs"`
+	Rules    map[string]int64 `json:"rules"`
+	Unmapped map[string]int64 `json:"unmapped"`
+}
+
+type coverage struct {
+	mu       sync.Mutex
+	sections map[string]*CoverageSection
+	plans    []*RawPlan
+}
+
+func (c *coverage) register(plan *RawPlan) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.plans = append(c.plans, plan)
+}
+
+func newCoverage() *coverage {
+	return &coverage{sections: map[string]*CoverageSection{}}
+}
+
+func mongoSection(coll string) string    { return "mongo." + coll }
+func elasticSection(indic string) string { return "elastic." + indic }
+
+// section returns the counters of name, rules start at zero so dead rules
+// show up before any document arrived.
+func (c *coverage) section(name string, rules []rule) *CoverageSection {
+	s, ok := c.sections[name]
+	if !ok {
+		s = &CoverageSection{Section: name, Rules: map[string]int64{}, Unmapped: map[string]int64{}}
+		for _, r := range rules {
+			s.Rules[r.source] = 0
+		}
+		c.sections[name] = s
+	}
+	return s
+}
+
+func (c *coverage) add(name string, rules []rule, batch *coverageBatch) {
+	if batch.docs == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.section(name, rules)
+	s.Docs += batch.docs
+	for source, n := range batch.rules {
+		s.Rules[source] += n
+	}
+	for field, n := range batch.unmapped {
+		if _, ok := s.Unmapped[field]; !ok && len(s.Unmapped) >= maxUnmapped {
+			field = otherFields
+		}
+		s.Unmapped[field] += n
+	}
+}
+
+// coverageBatch collects the counts of one batch so the shared counters are
+// locked once per batch.
+type coverageBatch struct {
+	docs     int64
+	rules    map[string]int64
+	unmapped map[string]int64
+}
+
+func newCoverageBatch() *coverageBatch {
+	return &coverageBatch{rules: map[string]int64{}, unmapped: map[string]int64{}}
+}
+
+func (b *coverageBatch) rule(source string) {
+	if b != nil {
+		b.rules[source]++
+	}
+}
+
+// fields counts the fields of doc that no rule reads, rules are sorted by
+// source.
+func (b *coverageBatch) fields(doc map[string]any, rules []rule, skip map[string]bool) {
+	b.docs++
+	for field := range doc {
+		if skip[field] {
+			continue
+		}
+		i := sort.Search(len(rules), func(i int) bool { return rules[i].source >= field })
+		if i < len(rules) && rules[i].source == field {
+			continue
+		}
+		b.unmapped[field]++
+	}
+}
+
+// Coverage returns a snapshot of the mapping coverage counters.
+func (m *Mapper) Coverage() []CoverageSection {
+	m.coverage.mu.Lock()
+	plans := slices.Clone(m.coverage.plans)
+	m.coverage.mu.Unlock()
+	for _, plan := range plans {
+		plan.flushCoverage()
+	}
+	m.coverage.mu.Lock()
+	defer m.coverage.mu.Unlock()
+	sections := make([]CoverageSection, 0, len(m.coverage.sections))
+	for _, s := range m.coverage.sections {
+		sections = append(sections, CoverageSection{
+			Section:  s.Section,
+			Docs:     s.Docs,
+			Rules:    maps.Clone(s.Rules),
+			Unmapped: maps.Clone(s.Unmapped),
+		})
+	}
+	sort.Slice(sections, func(i, j int) bool { return sections[i].Section < sections[j].Section })
+	return sections
+}
+
+// CoverageSummary describes every section in a line: documents seen, rules
+// that never applied and the most frequent unmapped fields.
+func (m *Mapper) CoverageSummary(top int) []string {
+	lines := []string{}
+	for _, s := range m.Coverage() {
+		dead := []string{}
+		for source, n := range s.Rules {
+			if n == 0 {
+				dead = append(dead, source)
+			}
+		}
+		sort.Strings(dead)
+		unmapped := make([]string, 0, len(s.Unmapped))
+		for field := range s.Unmapped {
+			unmapped = append(unmapped, field)
+		}
+		sort.Slice(unmapped, func(i, j int) bool {
+			if s.Unmapped[unmapped[i]] != s.Unmapped[unmapped[j]] {
+				return s.Unmapped[unmapped[i]] > s.Unmapped[unmapped[j]]
+			}
+			return unmapped[i] < unmapped[j]
+		})
+		if len(unmapped) > top {
+			unmapped = unmapped[:top]
+		}
+		for i, field := range unmapped {
+			unmapped[i] = fmt.Sprintf("%s=%d", field, s.Unmapped[field])
+		}
+		line := fmt.Sprintf("%s: %d docs, %d/%d rules applied", s.Section, s.Docs, len(s.Rules)-len(dead), len(s.Rules))
+		if len(dead) > 0 {
+			line += ", never applied: " + strings.Join(dead, " ")
+		}
+		if len(unmapped) > 0 {
+			line += ", unmapped: " + strings.Join(unmapped, " ")
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
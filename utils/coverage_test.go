@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestCoverage(t *testing.T) {
+	newCoverageMapper := func() *Mapper {
+		m, err := newMapper(&Mappings{
+			MongoMappings: map[string]map[string]any{
+				"users": {"name": "first_name", "stats": map[string]any{"country": "country"}, "nmae": "typo"},
+			},
+			ElasticMappings: map[string]map[string]any{
+				"user_index": {"first_name": "given_name", "missing": "never"},
+			},
+			Indices: map[string]IndexOptions{"user_index": {Mode: ModePassthrough}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	raws := []bson.Raw{}
+	for _, doc := range []bson.D{
+		{{Key: "name", Value: "a"}, {Key: "age", Value: int32(1)}, {Key: "stats", Value: bson.D{{Key: "country", Value: "FR"}}}},
+		{{Key: "name", Value: "b"}, {Key: "age", Value: int32(2)}},
+	} {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raws = append(raws, raw)
+	}
+	want := []CoverageSection{
+		{
+			Section:  "elastic.user_index",
+			Docs:     2,
+			Rules:    map[string]int64{"first_name": 2, "missing": 0},
+			Unmapped: map[string]int64{"age": 2, "country": 1},
+		},
+		{
+			Section:  "mongo.users",
+			Docs:     2,
+			Rules:    map[string]int64{"name": 2, "nmae": 0, "stats.country": 1},
+			Unmapped: map[string]int64{"age": 2},
+		},
+	}
+
+	mapped := newCoverageMapper()
+	if _, err := mapped.Map("users", "user_index", raws); err != nil {
+		t.Fatal(err)
+	}
+	if got := mapped.Coverage(); !reflect.DeepEqual(got, want) {
+		t.Errorf("map path:\n got %+v\nwant %+v", got, want)
+	}
+
+	raw := newCoverageMapper()
+	plan, ok := raw.RawPlan("users", "user_index")
+	if !ok {
+		t.Fatal("expected a raw plan")
+	}
+	for _, doc := range raws {
+		if _, _, err := plan.AppendJSON(nil, doc, NewEncoder(EncodingConf{}), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := raw.Coverage(); !reflect.DeepEqual(got, want) {
+		t.Errorf("raw path:\n got %+v\nwant %+v", got, want)
+	}
+
+	summary := mapped.CoverageSummary(1)
+	if len(summary) != 2 || summary[1] != "mongo.users: 2 docs, 2/3 rules applied, never applied: nmae, unmapped: age=2" {
+		t.Errorf("unexpected summary %q", strings.Join(summary, "\n"))
+	}
+}
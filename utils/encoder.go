@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var encodingOptions = map[string][]string{
+	"object_id": {"hex", "extended"},
+	"decimal":   {"string", "double"},
+	"date":      {"iso", "epoch_millis"},
+	"binary":    {"base64", "hex"},
+	"uuid":      {"canonical", "base64"},
+}
+
+func (c EncodingConf) withDefaults() EncodingConf {
+	if c.ObjectID == "" {
+		c.ObjectID = "hex"
+	}
+	if c.Decimal == "" {
+		c.Decimal = "string"
+	}
+	if c.Date == "" {
+		c.Date = "iso"
+	}
+	if c.Binary == "" {
+		c.Binary = "base64"
+	}
+	if c.UUID == "" {
+		c.UUID = "canonical"
+	}
+	return c
+}
+
+func (c EncodingConf) Validate() error {
+	c = c.withDefaults()
+	values := map[string]string{
+		"object_id": c.ObjectID,
+		"decimal":   c.Decimal,
+		"date":      c.Date,
+		"binary":    c.Binary,
+		"uuid":      c.UUID,
+	}
+	for key, value := range values {
+		valid := false
+		for _, option := range encodingOptions[key] {
+			valid = valid || option == value
+		}
+		if !valid {
+			return fmt.Errorf("unknown %s encoding %q, expected one of %v", key, value, encodingOptions[key])
+		}
+	}
+	return nil
+}
+
+// Encoder converts values decoded from BSON into types that marshal to
+// JSON the way Elasticsearch expects them.
+type Encoder struct {
+	cfg EncodingConf
+}
+
+func NewEncoder(cfg EncodingConf) *Encoder {
+	return &Encoder{cfg: cfg.withDefaults()}
+}
+
+func (e *Encoder) EncodeDoc(doc map[string]any) map[string]any {
+	out := make(map[string]any, len(doc))
+	for k, v := range doc {
+		out[k] = e.Encode(v)
+	}
+	return out
+}
+
+func (e *Encoder) Encode(value any) any {
+	switch v := value.(type) {
+	case nil, string, bool, int32, int64, int:
+		return v
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil
+		}
+		return v
+	case map[string]any:
+		return e.EncodeDoc(v)
+	case bson.M:
+		return e.EncodeDoc(v)
+	case bson.D:
+		return e.EncodeDoc(v.Map())
+	case bson.A:
+		return e.encodeSlice(v)
+	case []any:
+		return e.encodeSlice(v)
+	case primitive.ObjectID:
+		if e.cfg.ObjectID == "extended" {
+			return map[string]any{"$oid": v.Hex()}
+		}
+		return v.Hex()
+	case primitive.DateTime:
+		return e.encodeTime(v.Time())
+	case time.Time:
+		return e.encodeTime(v)
+	case primitive.Timestamp:
+		return e.encodeTime(time.Unix(int64(v.T), 0))
+	case primitive.Decimal128:
+		if e.cfg.Decimal == "double" {
+			f, err := strconv.ParseFloat(v.String(), 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return nil
+			}
+			return f
+		}
+		return v.String()
+	case primitive.Binary:
+		if (v.Subtype == bson.TypeBinaryUUID || v.Subtype == bson.TypeBinaryUUIDOld) && len(v.Data) == 16 {
+			if e.cfg.UUID == "canonical" {
+				return canonicalUUID(v.Data)
+			}
+			return base64.StdEncoding.EncodeToString(v.Data)
+		}
+		if e.cfg.Binary == "hex" {
+			return hex.EncodeToString(v.Data)
+		}
+		return base64.StdEncoding.EncodeToString(v.Data)
+	case primitive.Regex:
+		return fmt.Sprintf("/%s/%s", v.Pattern, v.Options)
+	case primitive.JavaScript:
+		return string(v)
+	case primitive.Symbol:
+		return string(v)
+	case primitive.CodeWithScope:
+		return string(v.Code)
+	case primitive.DBPointer:
+		return fmt.Sprintf("%s/%s", v.DB, v.Pointer.Hex())
+	case primitive.Null, primitive.Undefined, primitive.MinKey, primitive.MaxKey:
+		return nil
+	}
+	return value
+}
+
+func (e *Encoder) encodeSlice(items []any) []any {
+	out := make([]any, len(items))
+	for i, item := range items {
+		out[i] = e.Encode(item)
+	}
+	return out
+}
+
+func (e *Encoder) encodeTime(t time.Time) any {
+	if e.cfg.Date == "epoch_millis" {
+		return t.UnixMilli()
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+func canonicalUUID(b []byte) string {
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
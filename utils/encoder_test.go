@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestEncoder_Defaults(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
+	dec, _ := primitive.ParseDecimal128("1234.50")
+	date := time.Date(2025, 8, 21, 14, 51, 43, 120_000_000, time.UTC)
+	uuid := []byte{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00}
+
+	doc := map[string]any{
+		"_id":     oid,
+		"price":   dec,
+		"created": primitive.NewDateTimeFromTime(date),
+		"ts":      primitive.Timestamp{T: uint32(date.Unix()), I: 1},
+		"blob":    primitive.Binary{Subtype: 0, Data: []byte("hi")},
+		"uuid":    primitive.Binary{Subtype: bson.TypeBinaryUUID, Data: uuid},
+		"re":      primitive.Regex{Pattern: "^a", Options: "i"},
+		"nan":     math.NaN(),
+		"null":    primitive.Null{},
+		"nested":  map[string]any{"ids": bson.A{oid}},
+	}
+	got := NewEncoder(EncodingConf{}).EncodeDoc(doc)
+	want := map[string]any{
+		"_id":     "507f1f77bcf86cd799439011",
+		"price":   "1234.50",
+		"created": "2025-08-21T14:51:43.120Z",
+		"ts":      "2025-08-21T14:51:43.000Z",
+		"blob":    "aGk=",
+		"uuid":    "123e4567-e89b-12d3-a456-426614174000",
+		"re":      "/^a/i",
+		"nan":     nil,
+		"null":    nil,
+		"nested":  map[string]any{"ids": []any{"507f1f77bcf86cd799439011"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("\n got:  %#v\n want: %#v", got, want)
+	}
+	if _, err := json.Marshal(got); err != nil {
+		t.Fatalf("encoded doc should marshal: %v", err)
+	}
+}
+
+func TestEncoder_Options(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
+	dec, _ := primitive.ParseDecimal128("1234.50")
+	date := time.Date(2025, 8, 21, 14, 51, 43, 0, time.UTC)
+	e := NewEncoder(EncodingConf{ObjectID: "extended", Decimal: "double", Date: "epoch_millis", Binary: "hex", UUID: "base64"})
+
+	cases := []struct {
+		in   any
+		want any
+	}{
+		{oid, map[string]any{"$oid": "507f1f77bcf86cd799439011"}},
+		{dec, 1234.5},
+		{primitive.NewDateTimeFromTime(date), date.UnixMilli()},
+		{primitive.Binary{Data: []byte("hi")}, "6869"},
+		{primitive.Binary{Subtype: bson.TypeBinaryUUID, Data: make([]byte, 16)}, "AAAAAAAAAAAAAAAAAAAAAA=="},
+	}
+	for _, c := range cases {
+		if got := e.Encode(c.in); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%T: got %#v want %#v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestEncodingConf_Validate(t *testing.T) {
+	if err := (EncodingConf{}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (EncodingConf{Date: "unix"}).Validate(); err == nil {
+		t.Fatal("expected error for unknown date encoding")
+	}
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// NewLogger builds the logger described by c, text at info level by default.
+func NewLogger(c LogConf, w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if c.Level != "" {
+		if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q: %w", c.Level, err)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(c.Format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, use text or json", c.Format)
+}
+
+// SetupLogging makes the logger described by c the default one, log.Printf
+// calls of dependencies go through it too.
+func SetupLogging(c LogConf, w io.Writer) error {
+	logger, err := NewLogger(c, w)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
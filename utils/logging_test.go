@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(LogConf{Level: "warn", Format: "json"}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden", "collection", "users")
+	logger.Warn("schema drift", "collection", "users", "index", "user_index")
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a single json entry, got %q: %v", buf.String(), err)
+	}
+	if entry["msg"] != "schema drift" || entry["collection"] != "users" || entry["index"] != "user_index" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+
+	buf.Reset()
+	logger, err = NewLogger(LogConf{}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("hidden")
+	logger.Info("indexed docs", "batch_size", 3)
+	if got := buf.String(); !strings.Contains(got, "level=INFO msg=\"indexed docs\" batch_size=3") || strings.Contains(got, "hidden") {
+		t.Errorf("unexpected text output %q", got)
+	}
+
+	for _, conf := range []LogConf{{Level: "loud"}, {Format: "xml"}} {
+		if _, err := NewLogger(conf, &buf); err == nil {
+			t.Errorf("expected error for %+v", conf)
+		}
+	}
+}
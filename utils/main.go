@@ -1,7 +1,7 @@
 package utils
 
 import (
-	"fmt"
+	"log/slog"
 	"os"
 )
 
@@ -14,7 +14,7 @@ func Prepare() {
 	}
 	for _, dir := range dirs {
 		if err := os.MkdirAll(dir, 0755); err != nil {
-			fmt.Printf("error creating %s: %s", dir, err.Error())
+			slog.Error("failed to create dir", "dir", dir, "error", err)
 			os.Exit(1)
 		}
 	}
@@ -1,15 +1,27 @@
 package utils
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"maps"
+	"mongo-es/transform"
 
 	"reflect"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Mapper struct {
-	mappings *Mappings
+	mappings     *Mappings
+	mongoRules   map[string][]rule
+	esRules      map[string][]rule
+	arrays       map[string]map[string]arrayRule
+	computed     map[string][]computedField
+	transformers map[string][]transform.Transformer
+	coverage     *coverage
 }
 
 func NewMapper() (*Mapper, error) {
@@ -17,15 +29,74 @@ func NewMapper() (*Mapper, error) {
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("mappings: %v\n", mappings)
+	slog.Debug("loaded mappings", "mongo", len(mappings.MongoMappings), "elastic", len(mappings.ElasticMappings),
+		"indices", len(mappings.Indices), "computed", len(mappings.Computed))
+	return newMapper(mappings)
+}
+
+func newMapper(mappings *Mappings) (*Mapper, error) {
 	mp := &Mapper{
-		mappings: mappings,
+		mappings:     mappings,
+		mongoRules:   make(map[string][]rule),
+		esRules:      make(map[string][]rule),
+		arrays:       make(map[string]map[string]arrayRule),
+		computed:     make(map[string][]computedField),
+		transformers: make(map[string][]transform.Transformer),
+		coverage:     newCoverage(),
+	}
+	for coll, section := range mappings.MongoMappings {
+		rules, err := compileRules(section)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mongo mapping for %s: %w", coll, err)
+		}
+		mp.mongoRules[coll] = rules
+		mp.coverage.section(mongoSection(coll), rules)
+	}
+	for indic, section := range mappings.ElasticMappings {
+		rules, err := compileRules(section)
+		if err != nil {
+			return nil, fmt.Errorf("invalid elastic mapping for %s: %w", indic, err)
+		}
+		mp.esRules[indic] = rules
+		mp.coverage.section(elasticSection(indic), rules)
+	}
+	for coll, section := range mappings.Computed {
+		fields, err := compileComputed(section)
+		if err != nil {
+			return nil, fmt.Errorf("invalid computed fields for %s: %w", coll, err)
+		}
+		mp.computed[coll] = fields
+	}
+	for indic, opts := range mappings.Indices {
+		if err := validateIndexOptions(indic, opts); err != nil {
+			return nil, err
+		}
+		for _, name := range opts.Transformers {
+			t, ok := transform.Get(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown transformer %q for %s, registered: %v", name, indic, transform.Names())
+			}
+			mp.transformers[indic] = append(mp.transformers[indic], t)
+		}
+		if len(opts.Arrays) == 0 {
+			continue
+		}
+		arrays, err := compileArrays(opts.Arrays)
+		if err != nil {
+			return nil, fmt.Errorf("invalid arrays for %s: %w", indic, err)
+		}
+		mp.arrays[indic] = arrays
 	}
 	return mp, nil
 }
 
 func (m *Mapper) ProcessedMapper(coll string, processed []bson.Raw) ([]map[string]any, error) {
-	maps := m.mappings.MongoMappings[coll]
+	rules, counted := m.mongoRules[coll]
+	var batch *coverageBatch
+	if counted {
+		batch = newCoverageBatch()
+		defer m.coverage.add(mongoSection(coll), rules, batch)
+	}
 	docs := []map[string]any{}
 	for _, item := range processed {
 		var doc map[string]any
@@ -35,54 +106,179 @@ func (m *Mapper) ProcessedMapper(coll string, processed []bson.Raw) ([]map[strin
 
 		flattened := make(map[string]any)
 		flatten("", doc, flattened)
-		for key, value := range flattened {
-			if newKey, ok := maps[key]; ok {
-				delete(flattened, key)
-				flattened[newKey.(string)] = value
-			}
+		paths := make(map[string][]string, len(flattened))
+		fieldPaths(nil, doc, paths)
+		if batch != nil {
+			batch.fields(flattened, rules, nil)
+		}
+		mapped, err := applyRules(flattened, rules, keepAll, batch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to map %s doc: %w", coll, err)
 		}
-		docs = append(docs, flattened)
+		// keep the source structure so indices can choose their own shape
+		mapped = shapeDoc(mapped, ShapeOriginal, paths)
+		if err := compute(mapped, m.computed[coll]); err != nil {
+			return nil, fmt.Errorf("failed to map %s doc: %w", coll, err)
+		}
+		docs = append(docs, mapped)
 	}
 
 	return docs, nil
 }
 
 func (m *Mapper) EsMapper(indic string, processed []map[string]any) ([]map[string]any, error) {
-	maps, exists := m.mappings.ElasticMappings[indic]
-	if !exists {
-		return processed, nil
+	rules, counted := m.esRules[indic]
+	patterns := m.mappings.Indices[indic].Fields
+	mode := m.indexMode(indic)
+	shape := m.indexShape(indic)
+	arrays := m.arrays[indic]
+	keep := keepAll
+	switch mode {
+	case ModePassthrough:
+		if len(rules) == 0 && len(arrays) == 0 && shape == ShapeOriginal {
+			return processed, nil
+		}
+	case ModeAllowlist:
+		keep = func(field string) bool { return matchAny(patterns, field) }
 	}
 
+	var batch *coverageBatch
+	if counted {
+		batch = newCoverageBatch()
+		defer m.coverage.add(elasticSection(indic), rules, batch)
+	}
 	docs := make([]map[string]any, 0, len(processed))
 
 	for _, item := range processed {
 		flattened := make(map[string]any)
 		flatten("", item, flattened)
-		mapped := make(map[string]any)
-		for field, _ := range flattened {
-			// Check if type of flattened[field] is []any ([]interface{})
-			if slice, ok := flattened[field].([]interface{}); ok {
+		var paths map[string][]string
+		if shape == ShapeOriginal {
+			paths = make(map[string][]string, len(flattened))
+			fieldPaths(nil, item, paths)
+		}
+		expanded := map[string]bool{}
+		for field, value := range flattened {
+			if _, ok := arrays[field]; ok {
+				continue
+			}
+			// arrays of objects without a strategy become parallel arrays
+			if slice, ok := asSlice(value); ok {
 				flatmap, ok := toMapSliceLoose(slice)
 				if !ok {
 					continue
 				}
 				for k, v := range flatObjectMap(flatmap) {
-					flattened[fmt.Sprintf("%s.%s", field, k)] = v
+					key := fmt.Sprintf("%s.%s", field, k)
+					flattened[key] = v
+					expanded[key] = true
 				}
 			}
 		}
-
-		for key, value := range flattened {
-			if newKey, ok := maps[key]; ok {
-				mapped[newKey.(string)] = value
+		for _, array := range arrays {
+			if err := array.apply(flattened, shape); err != nil {
+				return nil, fmt.Errorf("failed to map %s doc: %w", indic, err)
 			}
 		}
 
-		docs = append(docs, mapped)
+		if batch != nil {
+			batch.fields(flattened, rules, expanded)
+		}
+		if mode == ModeDenylist {
+			maps.DeleteFunc(flattened, func(field string, _ any) bool { return matchAny(patterns, field) })
+		}
+		mapped, err := applyRules(flattened, rules, func(field string) bool {
+			// parallel arrays are only sent when asked for
+			return keep(field) && (mode == ModeAllowlist || !expanded[field])
+		}, batch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to map %s doc: %w", indic, err)
+		}
+		docs = append(docs, shapeDoc(mapped, shape, paths))
 	}
 	return docs, nil
 }
 
+// Transform runs the transformers of indic over mapped documents.
+func (m *Mapper) Transform(coll, indic string, docs []map[string]any) ([]map[string]any, error) {
+	transformers := m.transformers[indic]
+	if len(transformers) == 0 {
+		return docs, nil
+	}
+	meta := transform.Meta{Collection: coll, Index: indic}
+	out := make([]map[string]any, 0, len(docs))
+	for _, doc := range docs {
+		transformed, err := transform.Chain(meta, doc, transformers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to transform %s doc: %w", indic, err)
+		}
+		out = append(out, transformed...)
+	}
+	return out, nil
+}
+
+// Map runs the whole pipeline: mongo mappings, computed fields, elastic
+// mappings and transformers.
+func (m *Mapper) Map(coll, indic string, raws []bson.Raw) ([]map[string]any, error) {
+	return m.MapContext(context.Background(), coll, indic, raws)
+}
+
+// MapContext is Map with a span per stage joining the trace in ctx.
+func (m *Mapper) MapContext(ctx context.Context, coll, indic string, raws []bson.Raw) ([]map[string]any, error) {
+	attrs := trace.WithAttributes(attribute.String("collection", coll), attribute.String("index", indic), attribute.Int("docs", len(raws)))
+	_, span := tracer.Start(ctx, "mapper.processed", attrs)
+	processed, err := m.ProcessedMapper(coll, raws)
+	EndSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	_, span = tracer.Start(ctx, "mapper.elastic", attrs)
+	docs, err := m.EsMapper(indic, processed)
+	EndSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	_, span = tracer.Start(ctx, "mapper.transform", attrs)
+	docs, err = m.Transform(coll, indic, docs)
+	EndSpan(span, err)
+	return docs, err
+}
+
+func keepAll(string) bool { return true }
+
+// applyRules runs rules against doc. Fields without a rule are copied when
+// keep accepts them, fields renamed away or dropped are always removed. Rules
+// producing a value are counted in batch when it is set.
+func applyRules(doc map[string]any, rules []rule, keep func(string) bool, batch *coverageBatch) (map[string]any, error) {
+	out := make(map[string]any, len(doc))
+	for field, value := range doc {
+		if keep(field) {
+			out[field] = value
+		}
+	}
+	fields := make([]Field, 0, len(rules))
+	for _, r := range rules {
+		field, err := r.apply(doc)
+		if err != nil {
+			return nil, err
+		}
+		if field.Present {
+			batch.rule(r.source)
+		}
+		if field.Dropped || field.Name != r.source {
+			delete(out, r.source)
+		}
+		fields = append(fields, field)
+	}
+	for _, field := range fields {
+		if field.Dropped || !field.Present {
+			continue
+		}
+		out[field.Name] = field.Value
+	}
+	return out, nil
+}
+
 func flatten(prefix string, in map[string]any, out map[string]any) {
 	for k, v := range in {
 		key := k
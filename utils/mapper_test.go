@@ -15,14 +15,15 @@ func TestProcessedMapper(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	m := &Mapper{
-		mappings: mappings,
+	m, err := newMapper(mappings)
+	if err != nil {
+		t.Fatal(err)
 	}
 
 	doc := bson.D{
-		{"name", "Alice"},
-		{"last_name", "Smith"},
-		{"stats", bson.D{{"country", "USA"}}},
+		{Key: "name", Value: "Alice"},
+		{Key: "last_name", Value: "Smith"},
+		{Key: "stats", Value: bson.D{{Key: "country", Value: "USA"}}},
 	}
 	raw, err := bson.Marshal(doc)
 	if err != nil {
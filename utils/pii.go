@@ -0,0 +1,299 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const redacted = "[REDACTED]"
+
+// piiKey reads the secret of a keyed step from an environment variable or a
+// file, keys never live in mappings.yaml.
+func piiKey(conf StepConf) ([]byte, error) {
+	switch {
+	case conf.KeyEnv != "" && conf.KeyFile != "":
+		return nil, fmt.Errorf("%s takes key_env or key_file, not both", conf.Op)
+	case conf.KeyEnv != "":
+		key := os.Getenv(conf.KeyEnv)
+		if key == "" {
+			return nil, fmt.Errorf("%s key env %s is not set", conf.Op, conf.KeyEnv)
+		}
+		return []byte(key), nil
+	case conf.KeyFile != "":
+		data, err := os.ReadFile(conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s key file: %w", conf.Op, err)
+		}
+		key := strings.TrimSpace(string(data))
+		if key == "" {
+			return nil, fmt.Errorf("%s key file %s is empty", conf.Op, conf.KeyFile)
+		}
+		return []byte(key), nil
+	}
+	return nil, fmt.Errorf("%s needs key_env or key_file", conf.Op)
+}
+
+// piiString renders scalar values as the string privacy steps work on.
+func piiString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case primitive.ObjectID:
+		return v.Hex()
+	}
+	return fmt.Sprint(value)
+}
+
+// mapScalars applies fn to a value or to every element of an array of values,
+// so lists of emails or phone numbers are protected too.
+func mapScalars(value any, fn func(string) any) any {
+	if value == nil {
+		return nil
+	}
+	if items, ok := asSlice(value); ok {
+		out := make([]any, len(items))
+		for i, item := range items {
+			out[i] = mapScalars(item, fn)
+		}
+		return out
+	}
+	return fn(piiString(value))
+}
+
+type hmacStep struct {
+	key []byte
+}
+
+func (s hmacStep) Apply(field *Field, _ map[string]any) error {
+	if field.Present {
+		field.Value = mapScalars(field.Value, func(v string) any {
+			mac := hmac.New(sha256.New, s.key)
+			mac.Write([]byte(v))
+			return hex.EncodeToString(mac.Sum(nil))
+		})
+	}
+	return nil
+}
+
+// maskStep replaces every character but the first keepStart and last keepEnd
+// ones, values too short to keep anything are masked entirely.
+type maskStep struct {
+	keepStart int
+	keepEnd   int
+	char      rune
+}
+
+func (s maskStep) Apply(field *Field, _ map[string]any) error {
+	if field.Present {
+		field.Value = mapScalars(field.Value, func(v string) any {
+			runes := []rune(v)
+			keepStart, keepEnd := s.keepStart, s.keepEnd
+			if keepStart+keepEnd >= len(runes) {
+				keepStart, keepEnd = 0, 0
+			}
+			for i := keepStart; i < len(runes)-keepEnd; i++ {
+				runes[i] = s.char
+			}
+			return string(runes)
+		})
+	}
+	return nil
+}
+
+type redactStep struct {
+	value any
+}
+
+func (s redactStep) Apply(field *Field, _ map[string]any) error {
+	if field.Present && field.Value != nil {
+		field.Value = s.value
+	}
+	return nil
+}
+
+// tokenizeStep replaces letters and digits with ones derived from an HMAC of
+// the value, so tokens are stable, keep the format of the value and can be
+// searched for exactly.
+type tokenizeStep struct {
+	key []byte
+}
+
+func (s tokenizeStep) Apply(field *Field, _ map[string]any) error {
+	if field.Present {
+		field.Value = mapScalars(field.Value, s.token)
+	}
+	return nil
+}
+
+func (s tokenizeStep) token(v string) any {
+	var stream []byte
+	for block := byte(0); len(stream) < len(v); block++ {
+		mac := hmac.New(sha256.New, s.key)
+		mac.Write([]byte{block})
+		mac.Write([]byte(v))
+		stream = mac.Sum(stream)
+	}
+	runes := []rune(v)
+	for i, r := range runes {
+		b := stream[i%len(stream)]
+		switch {
+		case unicode.IsDigit(r):
+			runes[i] = '0' + rune(b%10)
+		case unicode.IsUpper(r):
+			runes[i] = 'A' + rune(b%26)
+		case unicode.IsLetter(r):
+			runes[i] = 'a' + rune(b%26)
+		}
+	}
+	return string(runes)
+}
+
+// protects reports whether a step keeps a field's value out of the index.
+func protects(step Step) bool {
+	switch step.(type) {
+	case hmacStep, maskStep, redactStep, tokenizeStep, dropStep:
+		return true
+	}
+	return false
+}
+
+// exposes lists the other fields a rule copies into its value with no
+// privacy step running afterwards.
+func (r rule) exposes() []string {
+	exposed := []string{}
+	for i, step := range r.steps {
+		concat, ok := step.(concatStep)
+		if !ok || slices.ContainsFunc(r.steps[i+1:], protects) {
+			continue
+		}
+		for _, name := range concat.fields {
+			if name != r.source {
+				exposed = append(exposed, name)
+			}
+		}
+	}
+	return exposed
+}
+
+// protectedSources returns the fields a rule hashes, masks, redacts,
+// tokenizes or drops.
+func protectedSources(rules []rule) map[string]bool {
+	protected := map[string]bool{}
+	for _, r := range rules {
+		if slices.ContainsFunc(r.steps, protects) {
+			protected[r.source] = true
+		}
+	}
+	return protected
+}
+
+// checkExposed refuses rules copying the raw value of a protected field, concat
+// reads the source document and would index it as is.
+func checkExposed(rules []rule) error {
+	protected := protectedSources(rules)
+	for _, r := range rules {
+		for _, name := range r.exposes() {
+			if protected[name] {
+				return fmt.Errorf("%s concatenates %s which has a privacy rule, add a privacy step after the concat", r.source, name)
+			}
+		}
+	}
+	return nil
+}
+
+// PIIFinding is a field that looks like personal data but is indexed as is.
+type PIIFinding struct {
+	Field string
+	Kind  string
+}
+
+var piiNames = []struct {
+	kind string
+	re   *regexp.Regexp
+}{
+	{"email", regexp.MustCompile(`(?i)(^|[._])e_?mail(s|_address)?$`)},
+	{"phone", regexp.MustCompile(`(?i)(^|[._])(phone|mobile|tel|telephone|fax)(_?(number|no))?s?$`)},
+	{"national id", regexp.MustCompile(`(?i)(^|[._])(ssn|nin|national_?id|passport(_?(number|no))?|tax_?id|id_?card)$`)},
+	{"payment card", regexp.MustCompile(`(?i)(^|[._])(card_?number|credit_?card|iban)$`)},
+}
+
+var piiValues = []struct {
+	kind string
+	re   *regexp.Regexp
+}{
+	{"email", regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[a-zA-Z]{2,}$`)},
+	{"national id", regexp.MustCompile(`^\d{3}-\d{2}-\d{4}$`)},
+	{"phone", regexp.MustCompile(`^(\+\d|\(\d)[\d ().-]{6,}\d$`)},
+}
+
+// PIIScan flags fields of sampled documents whose name or values look like
+// personal data and that no mongo rule of coll hashes, masks, redacts,
+// tokenizes or drops, or that another rule concatenates unprotected.
+func (m *Mapper) PIIScan(coll string, raws []bson.Raw) ([]PIIFinding, error) {
+	rules := m.mongoRules[coll]
+	covered := protectedSources(rules)
+	// a protected field copied as is by another rule is indexed anyway
+	for _, r := range rules {
+		for _, name := range r.exposes() {
+			delete(covered, name)
+		}
+	}
+	found := map[string]string{}
+	for _, raw := range raws {
+		var doc map[string]any
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal doc: %w", err)
+		}
+		flattened := make(map[string]any)
+		flatten("", doc, flattened)
+		for field, value := range flattened {
+			if covered[field] || found[field] != "" {
+				continue
+			}
+			if kind := piiKind(field, value); kind != "" {
+				found[field] = kind
+			}
+		}
+	}
+	findings := make([]PIIFinding, 0, len(found))
+	for field, kind := range found {
+		findings = append(findings, PIIFinding{Field: field, Kind: kind})
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Field < findings[j].Field })
+	return findings, nil
+}
+
+func piiKind(field string, value any) string {
+	for _, p := range piiNames {
+		if p.re.MatchString(field) {
+			return p.kind
+		}
+	}
+	values := []any{value}
+	if items, ok := asSlice(value); ok {
+		values = items
+	}
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		for _, p := range piiValues {
+			if p.re.MatchString(strings.TrimSpace(s)) {
+				return p.kind
+			}
+		}
+	}
+	return ""
+}
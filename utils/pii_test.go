@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPrivacySteps(t *testing.T) {
+	t.Setenv("PII_TEST_KEY", "secret")
+	keep := 0
+	cases := []struct {
+		name  string
+		conf  StepConf
+		value any
+		want  any
+	}{
+		// hex HMAC-SHA256 of "a@b.com" with key "secret"
+		{"hmac", StepConf{Op: "hmac", KeyEnv: "PII_TEST_KEY"}, "a@b.com",
+			"f2d15403cb47c2208bde2f9ae83e4decafe9e748ac524a447f682edbcafaa4c0"},
+		{"mask default", StepConf{Op: "mask"}, "+33612345678", "********5678"},
+		{"mask both ends", StepConf{Op: "mask", KeepStart: 1, KeepEnd: &keep, Char: "x"}, "alice", "axxxx"},
+		{"mask short", StepConf{Op: "mask"}, "1234", "****"},
+		{"mask list", StepConf{Op: "mask", KeepEnd: &keep}, []any{"ab", int32(12)}, []any{"**", "**"}},
+		{"redact", StepConf{Op: "redact"}, "123-45-6789", redacted},
+		{"redact value", StepConf{Op: "redact", Value: ""}, "123-45-6789", ""},
+	}
+	for _, c := range cases {
+		got := applyStep(t, c.conf, Field{Name: "a", Value: c.value, Present: true}, nil)
+		if !reflect.DeepEqual(got.Value, c.want) {
+			t.Errorf("%s: got %#v want %#v", c.name, got.Value, c.want)
+		}
+	}
+
+	missing := applyStep(t, StepConf{Op: "redact"}, Field{Name: "a"}, nil)
+	if missing.Value != nil {
+		t.Errorf("redact set a missing field to %#v", missing.Value)
+	}
+}
+
+func TestKeyedStepsAreStable(t *testing.T) {
+	t.Setenv("PII_TEST_KEY", "secret")
+	file := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(file, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []string{"hmac", "tokenize"} {
+		fromEnv := applyStep(t, StepConf{Op: op, KeyEnv: "PII_TEST_KEY"}, Field{Value: "+1 (555) 010-9999", Present: true}, nil)
+		fromFile := applyStep(t, StepConf{Op: op, KeyFile: file}, Field{Value: "+1 (555) 010-9999", Present: true}, nil)
+		if fromEnv.Value != fromFile.Value {
+			t.Errorf("%s: env and file keys differ: %v %v", op, fromEnv.Value, fromFile.Value)
+		}
+		if fromEnv.Value == "+1 (555) 010-9999" {
+			t.Errorf("%s: value left as is", op)
+		}
+	}
+	token := applyStep(t, StepConf{Op: "tokenize", KeyEnv: "PII_TEST_KEY"}, Field{Value: "+1 (555) 010-9999", Present: true}, nil)
+	if !regexp.MustCompile(`^\+\d \(\d{3}\) \d{3}-\d{4}$`).MatchString(token.Value.(string)) {
+		t.Errorf("tokenize changed the format: %v", token.Value)
+	}
+	other := applyStep(t, StepConf{Op: "tokenize", KeyEnv: "PII_TEST_KEY"}, Field{Value: "+1 (555) 010-9998", Present: true}, nil)
+	if other.Value == token.Value {
+		t.Errorf("different values got the same token %v", token.Value)
+	}
+
+	for _, conf := range []StepConf{
+		{Op: "hmac"},
+		{Op: "hmac", KeyEnv: "PII_TEST_MISSING"},
+		{Op: "tokenize", KeyEnv: "PII_TEST_KEY", KeyFile: file},
+		{Op: "mask", Char: "**"},
+	} {
+		if _, err := NewStep(conf); err == nil {
+			t.Errorf("expected error for %+v", conf)
+		}
+	}
+}
+
+func TestPIIScan(t *testing.T) {
+	m, err := newMapper(&Mappings{
+		MongoMappings: map[string]map[string]any{"users": {
+			"email":   []any{map[string]any{"op": "redact"}},
+			"profile": map[string]any{"ssn": []any{map[string]any{"op": "drop"}}},
+			"name":    "full_name",
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := bson.Marshal(bson.D{
+		{Key: "email", Value: "a@b.com"},
+		{Key: "name", Value: "Alice"},
+		{Key: "contact", Value: "alice@example.com"},
+		{Key: "created", Value: "2024-01-01"},
+		{Key: "profile", Value: bson.D{
+			{Key: "ssn", Value: "123-45-6789"},
+			{Key: "mobile_number", Value: "0612345678"},
+			{Key: "tax", Value: "987-65-4321"},
+		}},
+		{Key: "phones", Value: bson.A{"+33 6 12 34 56 78"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	findings, err := m.PIIScan("users", []bson.Raw{raw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PIIFinding{
+		{Field: "contact", Kind: "email"},
+		{Field: "phones", Kind: "phone"},
+		{Field: "profile.mobile_number", Kind: "phone"},
+		{Field: "profile.tax", Kind: "national id"},
+	}
+	if !reflect.DeepEqual(findings, want) {
+		t.Errorf("got %v want %v", findings, want)
+	}
+}
+
+func TestConcatProtectedField(t *testing.T) {
+	t.Setenv("PII_TEST_KEY", "secret")
+	concat := map[string]any{"op": "concat", "fields": []any{"name", "email"}}
+	_, err := newMapper(&Mappings{
+		MongoMappings: map[string]map[string]any{"users": {
+			"email":   []any{map[string]any{"op": "redact"}},
+			"contact": []any{concat},
+		}},
+	})
+	if err == nil {
+		t.Fatal("expected error concatenating a redacted field")
+	}
+	if _, err := newMapper(&Mappings{
+		MongoMappings: map[string]map[string]any{"users": {
+			"email":   []any{map[string]any{"op": "redact"}},
+			"contact": []any{concat, map[string]any{"op": "hmac", "key_env": "PII_TEST_KEY"}},
+		}},
+	}); err != nil {
+		t.Fatalf("concat hashed afterwards should be accepted: %v", err)
+	}
+}
+
+func TestPIIScanExposed(t *testing.T) {
+	m := &Mapper{mongoRules: map[string][]rule{"users": {
+		{source: "contact", steps: []Step{concatStep{fields: []string{"contact", "email"}, separator: " "}}},
+		{source: "email", steps: []Step{redactStep{value: redacted}}},
+	}}}
+	raw, err := bson.Marshal(bson.D{{Key: "email", Value: "a@b.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	findings, err := m.PIIScan("users", []bson.Raw{raw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PIIFinding{{Field: "email", Kind: "email"}}
+	if !reflect.DeepEqual(findings, want) {
+		t.Errorf("got %v want %v", findings, want)
+	}
+}
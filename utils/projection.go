@@ -0,0 +1,238 @@
+package utils
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	ModePassthrough = "passthrough"
+	ModeAllowlist   = "allowlist"
+	ModeDenylist    = "denylist"
+)
+
+// indexMode resolves the projection mode of an index, indices with an elastic
+// section default to allowlist and everything else to passthrough.
+func (m *Mapper) indexMode(indic string) string {
+	if mode := m.mappings.Indices[indic].Mode; mode != "" {
+		return mode
+	}
+	if _, exists := m.esRules[indic]; exists {
+		return ModeAllowlist
+	}
+	return ModePassthrough
+}
+
+func validateIndexOptions(indic string, opts IndexOptions) error {
+	switch opts.Mode {
+	case "", ModePassthrough, ModeAllowlist, ModeDenylist:
+	default:
+		return fmt.Errorf("unknown mode %q for %s", opts.Mode, indic)
+	}
+	if err := validateShape(indic, opts.Shape); err != nil {
+		return err
+	}
+	for _, pattern := range opts.Fields {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid field pattern %q for %s: %w", pattern, indic, err)
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns []string, field string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, field); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleOutput reports the field a rule writes to and the source fields it reads.
+func ruleOutput(r rule) (string, []string) {
+	name := r.source
+	inputs := []string{r.source}
+	for _, step := range r.steps {
+		switch s := step.(type) {
+		case renameStep:
+			name = s.to
+		case concatStep:
+			inputs = append(inputs, s.fields...)
+		case dropStep:
+			return "", inputs
+		}
+	}
+	return name, inputs
+}
+
+// Projection returns the MongoDB projection needed to feed every index in
+// indices from coll, or nil when every field has to be read.
+func (m *Mapper) Projection(coll string, indices ...string) bson.D {
+	var merged bson.D
+	for i, indic := range indices {
+		projection := m.indexProjection(coll, indic)
+		if projection == nil {
+			return nil
+		}
+		if i == 0 {
+			merged = projection
+			continue
+		}
+		if merged[0].Value != projection[0].Value {
+			// inclusion and exclusion cannot be combined
+			return nil
+		}
+		if projection[0].Value == 1 {
+			// fields needed by any index
+			merged = projectionDoc(append(projectionPaths(merged), projectionPaths(projection)...), 1)
+			continue
+		}
+		// fields excluded by every index
+		a, b := projectionPaths(merged), projectionPaths(projection)
+		paths := append(coveredPaths(a, b), coveredPaths(b, a)...)
+		if merged = projectionDoc(paths, 0); merged == nil {
+			return nil
+		}
+	}
+	return merged
+}
+
+func projectionPaths(projection bson.D) []string {
+	paths := make([]string, 0, len(projection))
+	for _, e := range projection {
+		paths = append(paths, e.Key)
+	}
+	return paths
+}
+
+// coveredPaths returns the paths that are equal to or inside one of by.
+func coveredPaths(paths, by []string) []string {
+	covered := []string{}
+	for _, p := range paths {
+		if slices.ContainsFunc(by, func(b string) bool { return p == b || strings.HasPrefix(p, b+".") }) {
+			covered = append(covered, p)
+		}
+	}
+	return covered
+}
+
+func (m *Mapper) indexProjection(coll, indic string) bson.D {
+	opts := m.mappings.Indices[indic]
+	switch m.indexMode(indic) {
+	case ModeAllowlist:
+		needed := slices.Clone(opts.Fields)
+		for _, r := range m.esRules[indic] {
+			_, inputs := ruleOutput(r)
+			needed = append(needed, inputs...)
+		}
+		for _, field := range m.computed[coll] {
+			needed = append(needed, field.inputs()...)
+		}
+		paths := []string{}
+		for _, field := range needed {
+			field, ok := pushablePath(field)
+			if !ok {
+				return nil
+			}
+			paths = append(paths, m.mongoSources(coll, field)...)
+		}
+		return projectionDoc(paths, 1)
+	case ModeDenylist:
+		paths := []string{}
+		for _, field := range opts.Fields {
+			field, ok := pushablePath(field)
+			if !ok {
+				continue
+			}
+			paths = append(paths, m.excludableSources(coll, field)...)
+		}
+		return projectionDoc(paths, 0)
+	}
+	return nil
+}
+
+// pushablePath turns a field pattern into a MongoDB path, only exact fields and
+// trailing ".*" patterns can be expressed as a projection.
+func pushablePath(pattern string) (string, bool) {
+	if base, ok := strings.CutSuffix(pattern, ".*"); ok {
+		pattern = base
+	}
+	if strings.ContainsAny(pattern, "*?[\\") {
+		return "", false
+	}
+	return pattern, true
+}
+
+func (m *Mapper) mongoSources(coll, field string) []string {
+	sources := []string{}
+	for _, r := range m.mongoRules[coll] {
+		name, inputs := ruleOutput(r)
+		if name == field || strings.HasPrefix(name, field+".") {
+			sources = append(sources, inputs...)
+		}
+	}
+	if len(sources) == 0 {
+		sources = append(sources, field)
+	}
+	return sources
+}
+
+func (m *Mapper) excludableSources(coll, field string) []string {
+	for _, computed := range m.computed[coll] {
+		for _, input := range computed.inputs() {
+			if input == field || strings.HasPrefix(input, field+".") {
+				// read by a computed field
+				return nil
+			}
+		}
+	}
+	sources := []string{field}
+	for _, r := range m.mongoRules[coll] {
+		name, inputs := ruleOutput(r)
+		if name == "" {
+			continue
+		}
+		if name == field || strings.HasPrefix(name, field+".") {
+			if len(inputs) != 1 {
+				return nil
+			}
+			sources = append(sources, r.source)
+			continue
+		}
+		for _, input := range inputs {
+			if input == field || strings.HasPrefix(input, field+".") {
+				// still read by a rule feeding another field
+				return nil
+			}
+		}
+	}
+	return sources
+}
+
+func projectionDoc(paths []string, value int) bson.D {
+	if len(paths) == 0 {
+		return nil
+	}
+	sort.Strings(paths)
+	projection := bson.D{}
+	for _, p := range paths {
+		// drop duplicates and children of an already projected path, mongo
+		// rejects colliding paths
+		if slices.ContainsFunc(projection, func(e bson.E) bool {
+			return p == e.Key || strings.HasPrefix(p, e.Key+".")
+		}) {
+			continue
+		}
+		projection = append(projection, bson.E{Key: p, Value: value})
+	}
+	if value == 1 && !slices.ContainsFunc(projection, func(e bson.E) bool { return e.Key == "_id" }) {
+		projection = append(projection, bson.E{Key: "_id", Value: 1})
+	}
+	return projection
+}
@@ -0,0 +1,155 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func projectionMapper(t *testing.T, opts IndexOptions) *Mapper {
+	t.Helper()
+	m, err := newMapper(&Mappings{
+		MongoMappings: map[string]map[string]any{
+			"users": {
+				"_id":   "id",
+				"stats": map[string]any{"country": "country"},
+				"full_name": []any{
+					map[string]any{"op": "concat", "fields": []any{"first", "last"}},
+				},
+			},
+		},
+		ElasticMappings: map[string]map[string]any{
+			"user_index": {"id": "_id", "country": "location", "full_name": "name"},
+		},
+		Indices: map[string]IndexOptions{"user_index": opts},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestEsMapperModes(t *testing.T) {
+	doc := map[string]any{
+		"id":          "u1",
+		"country":     "US",
+		"password":    "secret",
+		"secret":      map[string]any{"token": "x", "key": "y"},
+		"tags":        []any{"a"},
+		"profile.bio": "hi",
+	}
+	cases := []struct {
+		opts IndexOptions
+		want map[string]any
+	}{
+		{IndexOptions{}, map[string]any{"_id": "u1", "location": "US"}},
+		{IndexOptions{Mode: ModeAllowlist, Fields: []string{"profile.*", "tags"}}, map[string]any{
+			"_id": "u1", "location": "US", "profile.bio": "hi", "tags": []any{"a"},
+		}},
+		{IndexOptions{Mode: ModePassthrough}, map[string]any{
+			"_id": "u1", "location": "US", "password": "secret", "secret.token": "x", "secret.key": "y",
+			"tags": []any{"a"}, "profile.bio": "hi",
+		}},
+		{IndexOptions{Mode: ModeDenylist, Fields: []string{"password", "secret.*"}}, map[string]any{
+			"_id": "u1", "location": "US", "tags": []any{"a"}, "profile.bio": "hi",
+		}},
+	}
+	for _, c := range cases {
+		m := projectionMapper(t, c.opts)
+		got, err := m.EsMapper("user_index", []map[string]any{doc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got[0], c.want) {
+			t.Errorf("%+v\n got:  %#v\n want: %#v", c.opts, got[0], c.want)
+		}
+	}
+}
+
+func TestProjection(t *testing.T) {
+	cases := []struct {
+		name string
+		opts IndexOptions
+		want bson.D
+	}{
+		{"passthrough reads everything", IndexOptions{Mode: ModePassthrough}, nil},
+		{"allowlist maps fields back to mongo", IndexOptions{Mode: ModeAllowlist, Fields: []string{"profile.*"}}, bson.D{
+			{Key: "_id", Value: 1},
+			{Key: "first", Value: 1},
+			{Key: "full_name", Value: 1},
+			{Key: "last", Value: 1},
+			{Key: "profile", Value: 1},
+			{Key: "stats.country", Value: 1},
+		}},
+		{"allowlist with inner wildcard is not pushed down", IndexOptions{Mode: ModeAllowlist, Fields: []string{"*_at"}}, nil},
+		{"denylist excludes", IndexOptions{Mode: ModeDenylist, Fields: []string{"password", "secret.*", "*_tmp"}}, bson.D{
+			{Key: "password", Value: 0},
+			{Key: "secret", Value: 0},
+		}},
+		{"denylist keeps fields other rules read", IndexOptions{Mode: ModeDenylist, Fields: []string{"first"}}, nil},
+		{"denylist follows renames", IndexOptions{Mode: ModeDenylist, Fields: []string{"country"}}, bson.D{
+			{Key: "country", Value: 0},
+			{Key: "stats.country", Value: 0},
+		}},
+	}
+	for _, c := range cases {
+		m := projectionMapper(t, c.opts)
+		got := m.Projection("users", "user_index")
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s\n got:  %v\n want: %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestProjectionDocCollisions(t *testing.T) {
+	got := projectionDoc([]string{"a.b", "a", "a-b", "a.c", "a"}, 1)
+	want := bson.D{{Key: "a", Value: 1}, {Key: "a-b", Value: 1}, {Key: "_id", Value: 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+}
+
+func TestValidateIndexOptions(t *testing.T) {
+	if err := validateIndexOptions("idx", IndexOptions{Mode: "blocklist"}); err == nil {
+		t.Error("expected error for unknown mode")
+	}
+	if err := validateIndexOptions("idx", IndexOptions{Mode: ModeDenylist, Fields: []string{"["}}); err == nil {
+		t.Error("expected error for bad pattern")
+	}
+}
+
+func TestProjectionFanOut(t *testing.T) {
+	m, err := newMapper(&Mappings{
+		Indices: map[string]IndexOptions{
+			"orders":        {Mode: ModeAllowlist, Fields: []string{"total", "items"}},
+			"orders_search": {Mode: ModeAllowlist, Fields: []string{"total", "customer.name"}},
+			"orders_slim":   {Mode: ModeDenylist, Fields: []string{"items", "notes"}},
+			"orders_audit":  {Mode: ModeDenylist, Fields: []string{"notes"}},
+			"orders_all":    {Mode: ModePassthrough},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		indices []string
+		want    bson.D
+	}{
+		{[]string{"orders", "orders_search"}, bson.D{
+			{Key: "_id", Value: 1},
+			{Key: "customer.name", Value: 1},
+			{Key: "items", Value: 1},
+			{Key: "total", Value: 1},
+		}},
+		{[]string{"orders_slim", "orders_audit"}, bson.D{{Key: "notes", Value: 0}}},
+		{[]string{"orders", "orders_slim"}, nil},
+		{[]string{"orders", "orders_all"}, nil},
+	}
+	for _, c := range cases {
+		got := m.Projection("orders", c.indices...)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v\n got:  %v\n want: %v", c.indices, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package utils
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// ErrRawFallback is returned by RawPlan.AppendJSON when a document can only
+// be mapped through the map based path.
+var ErrRawFallback = errors.New("document needs map based mapping")
+
+// RawPlan maps documents of a collection into an index by walking bson.Raw
+// and writing JSON directly, without decoding them into maps. Only mappings
+// made of plain renames can be planned.
+type RawPlan struct {
+	mapper      *Mapper
+	coll        string
+	indic       string
+	mode        string
+	patterns    []string
+	mongo       map[string]string
+	elastic     map[string]string
+	wildcard    bool
+	arrayPrefix []string
+
+	// coverage counts are kept per source field and merged when read
+	mu      sync.Mutex
+	leaves  []string
+	docs    int64
+	sources map[string]*int64
+}
+
+// RawPlan reports whether documents of coll can be mapped into indic
+// without the map based path and returns the plan doing it.
+func (m *Mapper) RawPlan(coll, indic string) (*RawPlan, bool) {
+	if m.indexShape(indic) != ShapeFlattened || len(m.arrays[indic]) > 0 || len(m.computed[coll]) > 0 ||
+		len(m.transformers[indic]) > 0 {
+		return nil, false
+	}
+	mongo, ok := renameRules(m.mongoRules[coll])
+	if !ok {
+		return nil, false
+	}
+	elastic, ok := renameRules(m.esRules[indic])
+	if !ok {
+		return nil, false
+	}
+	plan := &RawPlan{
+		mapper:   m,
+		coll:     coll,
+		indic:    indic,
+		mode:     m.indexMode(indic),
+		patterns: m.mappings.Indices[indic].Fields,
+		mongo:    mongo,
+		elastic:  elastic,
+		sources:  map[string]*int64{},
+	}
+	m.coverage.register(plan)
+	for _, pattern := range plan.patterns {
+		if strings.ContainsAny(pattern, "*?[\\") {
+			plan.wildcard = true
+		}
+	}
+	// rules reading into arrays of documents need parallel array expansion
+	for source := range elastic {
+		for i := strings.IndexByte(source, '.'); i > 0; i = nextDot(source, i) {
+			plan.arrayPrefix = append(plan.arrayPrefix, source[:i])
+		}
+	}
+	if plan.mode == ModeAllowlist {
+		for _, pattern := range plan.patterns {
+			for i := strings.IndexByte(pattern, '.'); i > 0; i = nextDot(pattern, i) {
+				plan.arrayPrefix = append(plan.arrayPrefix, pattern[:i])
+			}
+		}
+	}
+	return plan, true
+}
+
+func nextDot(s string, i int) int {
+	j := strings.IndexByte(s[i+1:], '.')
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+func renameRules(rules []rule) (map[string]string, bool) {
+	renames := make(map[string]string, len(rules))
+	for _, r := range rules {
+		if len(r.steps) != 1 {
+			return nil, false
+		}
+		rename, ok := r.steps[0].(renameStep)
+		if !ok {
+			return nil, false
+		}
+		renames[r.source] = rename.to
+	}
+	return renames, true
+}
+
+// Fallback maps a single document through the map based pipeline.
+func (p *RawPlan) Fallback(raw bson.Raw) (map[string]any, error) {
+	docs, err := p.mapper.Map(p.coll, p.indic, []bson.Raw{raw})
+	if err != nil {
+		return nil, err
+	}
+	return docs[0], nil
+}
+
+// output resolves the name a source field has after the mongo mappings and
+// the name it is indexed under.
+func (p *RawPlan) output(source string) (string, string, bool) {
+	name := source
+	if to, ok := p.mongo[source]; ok {
+		name = to
+	}
+	if p.mode == ModeDenylist && matchAny(p.patterns, name) {
+		return name, "", false
+	}
+	if to, ok := p.elastic[name]; ok {
+		return name, to, true
+	}
+	if p.mode == ModeAllowlist && !matchAny(p.patterns, name) {
+		return name, "", false
+	}
+	return name, name, true
+}
+
+// flushCoverage moves the field counts of the plan into the mapper counters,
+// resolving which rules the fields went through like the map path does.
+func (p *RawPlan) flushCoverage() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.docs == 0 {
+		return
+	}
+	mongoRules, countMongo := p.mapper.mongoRules[p.coll]
+	esRules, countElastic := p.mapper.esRules[p.indic]
+	mongoBatch, esBatch := newCoverageBatch(), newCoverageBatch()
+	mongoBatch.docs, esBatch.docs = p.docs, p.docs
+	for source, n := range p.sources {
+		if _, ok := p.mongo[source]; ok {
+			mongoBatch.rules[source] += *n
+		} else {
+			mongoBatch.unmapped[source] += *n
+		}
+		processed, _, _ := p.output(source)
+		_, ok := p.elastic[processed]
+		switch {
+		case !ok:
+			esBatch.unmapped[processed] += *n
+		case p.mode != ModeDenylist || !matchAny(p.patterns, processed):
+			esBatch.rules[processed] += *n
+		}
+	}
+	if countMongo {
+		p.mapper.coverage.add(mongoSection(p.coll), mongoRules, mongoBatch)
+	}
+	if countElastic {
+		p.mapper.coverage.add(elasticSection(p.indic), esRules, esBatch)
+	}
+	p.docs = 0
+	clear(p.sources)
+}
+
+// IndexedName returns the name a source field is indexed under, or false
+// when the index leaves it out.
+func (p *RawPlan) IndexedName(source string) (string, bool) {
+	_, name, ok := p.output(source)
+	return name, ok
+}
+
+// needsExpansion reports whether an array of documents under name could be
+// read by a rule or pattern through parallel array expansion.
+func (p *RawPlan) needsExpansion(name string) bool {
+	if p.mode == ModeAllowlist && p.wildcard {
+		return true
+	}
+	return slices.Contains(p.arrayPrefix, name)
+}
+
+// AppendJSON appends the mapped document as JSON to dst, leaving out _id.
+// The values of the wanted output fields are decoded and returned so ids,
+// routing and index names can be resolved without another pass.
+func (p *RawPlan) AppendJSON(dst []byte, raw bson.Raw, enc *Encoder, want []string) ([]byte, map[string]any, error) {
+	w := rawWriter{plan: p, enc: enc, want: want, dst: append(dst, '{')}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w.leaves = p.leaves[:0]
+	if err := w.document("", raw); err != nil {
+		return dst, nil, err
+	}
+	// fallbacks are counted by the map path
+	p.leaves = w.leaves
+	p.docs++
+	for _, source := range w.leaves {
+		n, ok := p.sources[source]
+		if !ok {
+			n = new(int64)
+			p.sources[source] = n
+		}
+		*n++
+	}
+	return append(w.dst, '}'), w.fields, nil
+}
+
+type rawWriter struct {
+	plan   *RawPlan
+	enc    *Encoder
+	want   []string
+	dst    []byte
+	seen   []string
+	wrote  bool
+	fields map[string]any
+	// leaves holds the source name of every field written
+	leaves []string
+}
+
+func (w *rawWriter) document(prefix string, doc []byte) error {
+	rem, ok := documentElements(doc)
+	if !ok {
+		return fmt.Errorf("malformed document")
+	}
+	for len(rem) > 0 {
+		var elem bsoncore.Element
+		elem, rem, ok = bsoncore.ReadElement(rem)
+		if !ok {
+			return fmt.Errorf("malformed document element")
+		}
+		source := string(elem.KeyBytes())
+		if prefix != "" {
+			source = prefix + "." + source
+		}
+		value := elem.Value()
+		if value.Type == bsontype.EmbeddedDocument {
+			if err := w.document(source, value.Data); err != nil {
+				return err
+			}
+			continue
+		}
+		processed, name, ok := w.plan.output(source)
+		if value.Type == bsontype.Array && w.plan.needsExpansion(processed) && containsDocument(value.Data) {
+			return ErrRawFallback
+		}
+		w.leaves = append(w.leaves, source)
+		if !ok {
+			continue
+		}
+		if slices.Contains(w.seen, name) {
+			// two sources write the same field, the map path decides which wins
+			return ErrRawFallback
+		}
+		w.seen = append(w.seen, name)
+		if slices.Contains(w.want, name) {
+			if w.fields == nil {
+				w.fields = make(map[string]any, len(w.want))
+			}
+			var decoded any
+			if err := (bson.RawValue{Type: value.Type, Value: value.Data}).Unmarshal(&decoded); err != nil {
+				return fmt.Errorf("failed to decode %s: %w", source, err)
+			}
+			w.fields[name] = decoded
+		}
+		if name == "_id" {
+			continue
+		}
+		if w.wrote {
+			w.dst = append(w.dst, ',')
+		}
+		w.wrote = true
+		w.dst = appendJSONString(w.dst, name)
+		w.dst = append(w.dst, ':')
+		if err := w.value(value); err != nil {
+			return fmt.Errorf("failed to encode %s: %w", source, err)
+		}
+	}
+	return nil
+}
+
+func (w *rawWriter) value(v bsoncore.Value) error {
+	switch v.Type {
+	case bsontype.String:
+		s, ok := rawString(v.Data)
+		if !ok {
+			return fmt.Errorf("malformed string")
+		}
+		w.dst = appendJSONBytes(w.dst, s)
+		return nil
+	case bsontype.Int32:
+		w.dst = strconv.AppendInt(w.dst, int64(int32(binary.LittleEndian.Uint32(v.Data))), 10)
+		return nil
+	case bsontype.Int64:
+		w.dst = strconv.AppendInt(w.dst, int64(binary.LittleEndian.Uint64(v.Data)), 10)
+		return nil
+	case bsontype.Double:
+		w.dst = appendJSONFloat(w.dst, math.Float64frombits(binary.LittleEndian.Uint64(v.Data)))
+		return nil
+	case bsontype.Boolean:
+		w.dst = strconv.AppendBool(w.dst, v.Data[0] == 1)
+		return nil
+	case bsontype.Null, bsontype.Undefined, bsontype.MinKey, bsontype.MaxKey:
+		w.dst = append(w.dst, "null"...)
+		return nil
+	case bsontype.ObjectID:
+		if w.enc.cfg.ObjectID == "hex" {
+			w.dst = append(w.dst, '"')
+			w.dst = hex.AppendEncode(w.dst, v.Data[:12])
+			w.dst = append(w.dst, '"')
+			return nil
+		}
+	case bsontype.DateTime:
+		ms := int64(binary.LittleEndian.Uint64(v.Data))
+		if w.enc.cfg.Date == "epoch_millis" {
+			w.dst = strconv.AppendInt(w.dst, ms, 10)
+			return nil
+		}
+		w.dst = append(w.dst, '"')
+		w.dst = time.UnixMilli(ms).UTC().AppendFormat(w.dst, "2006-01-02T15:04:05.000Z07:00")
+		w.dst = append(w.dst, '"')
+		return nil
+	case bsontype.EmbeddedDocument:
+		return w.object(v.Data)
+	case bsontype.Array:
+		return w.array(v.Data)
+	}
+	// everything else goes through the encoder like the map path
+	var decoded any
+	if err := (bson.RawValue{Type: v.Type, Value: v.Data}).Unmarshal(&decoded); err != nil {
+		return err
+	}
+	data, err := json.Marshal(w.enc.Encode(decoded))
+	if err != nil {
+		return err
+	}
+	w.dst = append(w.dst, data...)
+	return nil
+}
+
+func (w *rawWriter) object(doc []byte) error {
+	rem, ok := documentElements(doc)
+	if !ok {
+		return fmt.Errorf("malformed document")
+	}
+	w.dst = append(w.dst, '{')
+	for first := true; len(rem) > 0; first = false {
+		var elem bsoncore.Element
+		elem, rem, ok = bsoncore.ReadElement(rem)
+		if !ok {
+			return fmt.Errorf("malformed document element")
+		}
+		if !first {
+			w.dst = append(w.dst, ',')
+		}
+		w.dst = appendJSONBytes(w.dst, elem.KeyBytes())
+		w.dst = append(w.dst, ':')
+		if err := w.value(elem.Value()); err != nil {
+			return err
+		}
+	}
+	w.dst = append(w.dst, '}')
+	return nil
+}
+
+func (w *rawWriter) array(arr []byte) error {
+	rem, ok := documentElements(arr)
+	if !ok {
+		return fmt.Errorf("malformed array")
+	}
+	w.dst = append(w.dst, '[')
+	for first := true; len(rem) > 0; first = false {
+		var elem bsoncore.Element
+		elem, rem, ok = bsoncore.ReadElement(rem)
+		if !ok {
+			return fmt.Errorf("malformed array element")
+		}
+		if !first {
+			w.dst = append(w.dst, ',')
+		}
+		if err := w.value(elem.Value()); err != nil {
+			return err
+		}
+	}
+	w.dst = append(w.dst, ']')
+	return nil
+}
+
+// documentElements returns the element bytes of a document or array.
+func documentElements(doc []byte) ([]byte, bool) {
+	length, _, ok := bsoncore.ReadLength(doc)
+	if !ok || length < 5 || int(length) > len(doc) {
+		return nil, false
+	}
+	return doc[4 : length-1], true
+}
+
+func containsDocument(arr []byte) bool {
+	rem, ok := documentElements(arr)
+	for ok && len(rem) > 0 {
+		var elem bsoncore.Element
+		if elem, rem, ok = bsoncore.ReadElement(rem); ok && elem.Value().Type == bsontype.EmbeddedDocument {
+			return true
+		}
+	}
+	return false
+}
+
+func rawString(data []byte) ([]byte, bool) {
+	if len(data) < 5 {
+		return nil, false
+	}
+	length := int(int32(binary.LittleEndian.Uint32(data)))
+	if length < 1 || 4+length > len(data) {
+		return nil, false
+	}
+	return data[4 : 4+length-1], true
+}
+
+func appendJSONString(dst []byte, s string) []byte {
+	if plainJSON(s) {
+		dst = append(dst, '"')
+		dst = append(dst, s...)
+		return append(dst, '"')
+	}
+	data, _ := json.Marshal(s)
+	return append(dst, data...)
+}
+
+func appendJSONBytes(dst []byte, s []byte) []byte {
+	if plainJSON(s) {
+		dst = append(dst, '"')
+		dst = append(dst, s...)
+		return append(dst, '"')
+	}
+	data, _ := json.Marshal(string(s))
+	return append(dst, data...)
+}
+
+// plainJSON reports whether s can be quoted as is, anything json.Marshal
+// would escape takes the slow path.
+func plainJSON[T string | []byte](s T) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c >= 0x80 || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			return false
+		}
+	}
+	return true
+}
+
+// appendJSONFloat formats f the way encoding/json does.
+func appendJSONFloat(dst []byte, f float64) []byte {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return append(dst, "null"...)
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	dst = strconv.AppendFloat(dst, f, format, -1, 64)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		n := len(dst)
+		if n >= 4 && dst[n-4] == 'e' && dst[n-3] == '-' && dst[n-2] == '0' {
+			dst[n-2] = dst[n-1]
+			dst = dst[:n-1]
+		}
+	}
+	return dst
+}
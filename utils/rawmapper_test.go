@@ -0,0 +1,187 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func rawMapper(tb testing.TB, opts IndexOptions) *Mapper {
+	tb.Helper()
+	m, err := newMapper(&Mappings{
+		MongoMappings: map[string]map[string]any{
+			"users": {
+				"_id":   "id",
+				"name":  "first_name",
+				"stats": map[string]any{"country": "user_country"},
+			},
+		},
+		ElasticMappings: map[string]map[string]any{
+			"user_index": {"id": "_id", "user_country": "country", "first_name": "first_name", "score": "score"},
+		},
+		Indices: map[string]IndexOptions{"user_index": opts},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return m
+}
+
+func rawDoc(tb testing.TB) bson.Raw {
+	tb.Helper()
+	raw, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: primitive.NewObjectID()},
+		{Key: "name", Value: "Alice <a&b>"},
+		{Key: "last_name", Value: "Smith\n"},
+		{Key: "score", Value: 12.5},
+		{Key: "tiny", Value: 1e-9},
+		{Key: "nan", Value: math.NaN()},
+		{Key: "visits", Value: int32(3)},
+		{Key: "total", Value: int64(1 << 40)},
+		{Key: "active", Value: true},
+		{Key: "deleted", Value: nil},
+		{Key: "created", Value: primitive.NewDateTimeFromTime(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC))},
+		{Key: "price", Value: primitive.NewDecimal128(0, 1250)},
+		{Key: "stats", Value: bson.D{
+			{Key: "country", Value: "US"},
+			{Key: "geo", Value: bson.D{{Key: "lat", Value: 1.5}, {Key: "lon", Value: 2.5}}},
+		}},
+		{Key: "tags", Value: bson.A{"a", int32(1), bson.D{{Key: "k", Value: "v"}}}},
+		{Key: "blob", Value: primitive.Binary{Data: []byte("data")}},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return raw
+}
+
+func mapPath(tb testing.TB, m *Mapper, enc *Encoder, raw bson.Raw) []byte {
+	tb.Helper()
+	processed, err := m.ProcessedMapper("users", []bson.Raw{raw})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	docs, err := m.EsMapper("user_index", processed)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	delete(docs[0], "_id")
+	data, err := json.Marshal(enc.EncodeDoc(docs[0]))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+func TestRawPlanMatchesMapPath(t *testing.T) {
+	raw := rawDoc(t)
+	encoders := []EncodingConf{{}, {ObjectID: "extended", Date: "epoch_millis", Decimal: "double", Binary: "hex"}}
+	modes := []IndexOptions{
+		{},
+		{Mode: ModePassthrough},
+		{Mode: ModeAllowlist, Fields: []string{"created", "stats.geo.lat", "tags"}},
+		{Mode: ModeDenylist, Fields: []string{"last_name", "stats.geo.*"}},
+	}
+	for _, opts := range modes {
+		for _, conf := range encoders {
+			m := rawMapper(t, opts)
+			enc := NewEncoder(conf)
+			plan, ok := m.RawPlan("users", "user_index")
+			if !ok {
+				t.Fatal("expected a raw plan")
+			}
+			got, fields, err := plan.AppendJSON(nil, raw, enc, []string{"_id", "country"})
+			if err != nil {
+				t.Fatalf("%v: %v", opts, err)
+			}
+			var gotDoc, wantDoc map[string]any
+			if err := json.Unmarshal(got, &gotDoc); err != nil {
+				t.Fatalf("%v: invalid json %s: %v", opts, got, err)
+			}
+			if err := json.Unmarshal(mapPath(t, m, enc, raw), &wantDoc); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotDoc, wantDoc) {
+				t.Errorf("%v %v:\n got %v\nwant %v", opts, conf, gotDoc, wantDoc)
+			}
+			if _, ok := fields["_id"].(primitive.ObjectID); !ok {
+				t.Errorf("expected _id meta field, got %v", fields)
+			}
+			if fields["country"] != "US" {
+				t.Errorf("expected country meta field, got %v", fields)
+			}
+		}
+	}
+}
+
+func TestRawPlanFallback(t *testing.T) {
+	m, err := newMapper(&Mappings{
+		MongoMappings: map[string]map[string]any{"users": {"nick": "name"}},
+		ElasticMappings: map[string]map[string]any{
+			"user_index": {"items.sku": "skus"},
+		},
+		Indices: map[string]IndexOptions{"user_index": {Mode: ModePassthrough}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, ok := m.RawPlan("users", "user_index")
+	if !ok {
+		t.Fatal("expected a raw plan")
+	}
+	for _, doc := range []bson.D{
+		{{Key: "nick", Value: "a"}, {Key: "name", Value: "b"}},
+		{{Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "x"}}}}},
+	} {
+		raw, _ := bson.Marshal(doc)
+		if _, _, err := plan.AppendJSON(nil, raw, NewEncoder(EncodingConf{}), nil); !errors.Is(err, ErrRawFallback) {
+			t.Errorf("%v: expected fallback, got %v", doc, err)
+		}
+	}
+
+	m, err = newMapper(&Mappings{
+		MongoMappings: map[string]map[string]any{
+			"users": {"name": []any{map[string]any{"op": "format", "style": "upper"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.RawPlan("users", "user_index"); ok {
+		t.Error("expected no raw plan for value steps")
+	}
+}
+
+func BenchmarkMapPath(b *testing.B) {
+	m := rawMapper(b, IndexOptions{Mode: ModePassthrough})
+	enc := NewEncoder(EncodingConf{})
+	raw := rawDoc(b)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(raw)))
+	for b.Loop() {
+		mapPath(b, m, enc, raw)
+	}
+}
+
+func BenchmarkRawPath(b *testing.B) {
+	m := rawMapper(b, IndexOptions{Mode: ModePassthrough})
+	enc := NewEncoder(EncodingConf{})
+	raw := rawDoc(b)
+	plan, _ := m.RawPlan("users", "user_index")
+	want := []string{"_id"}
+	var buf []byte
+	b.ReportAllocs()
+	b.SetBytes(int64(len(raw)))
+	for b.Loop() {
+		var err error
+		if buf, _, err = plan.AppendJSON(buf[:0], raw, enc, want); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	ShapeFlattened = "flattened"
+	ShapeNested    = "nested"
+	ShapeOriginal  = "original"
+)
+
+func (m *Mapper) indexShape(indic string) string {
+	if shape := m.mappings.Indices[indic].Shape; shape != "" {
+		return shape
+	}
+	return ShapeFlattened
+}
+
+func validateShape(indic, shape string) error {
+	switch shape {
+	case "", ShapeFlattened, ShapeNested, ShapeOriginal:
+		return nil
+	}
+	return fmt.Errorf("unknown shape %q for %s", shape, indic)
+}
+
+// fieldPaths records the path segments of every field flatten produces, so
+// the original nesting can be restored after rules ran on dotted names.
+func fieldPaths(prefix []string, in map[string]any, paths map[string][]string) {
+	for k, v := range in {
+		segments := append(prefix[:len(prefix):len(prefix)], k)
+		if nested, ok := v.(map[string]any); ok {
+			fieldPaths(segments, nested, paths)
+			continue
+		}
+		paths[strings.Join(segments, ".")] = segments
+	}
+}
+
+// shapeDoc turns a flattened document into the requested shape. nested splits
+// every dotted name into objects, original keeps the structure fields had in
+// paths and only splits names written by rules.
+func shapeDoc(doc map[string]any, shape string, paths map[string][]string) map[string]any {
+	if shape == ShapeFlattened {
+		return doc
+	}
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	// parents sort before their children, so conflicts resolve the same way
+	// every time
+	sort.Strings(keys)
+	out := make(map[string]any, len(doc))
+	for _, key := range keys {
+		segments, ok := paths[key]
+		if shape == ShapeNested || !ok {
+			segments = strings.Split(key, ".")
+		}
+		setPath(out, segments, doc[key])
+	}
+	return out
+}
+
+// setPath stores value under segments, a field already holding a value where
+// an object is needed keeps the rest of the path as a dotted name.
+func setPath(doc map[string]any, segments []string, value any) {
+	for i, segment := range segments[:len(segments)-1] {
+		next, exists := doc[segment]
+		if !exists {
+			child := map[string]any{}
+			doc[segment] = child
+			doc = child
+			continue
+		}
+		child, ok := next.(map[string]any)
+		if !ok {
+			doc[strings.Join(segments[i:], ".")] = value
+			return
+		}
+		doc = child
+	}
+	doc[segments[len(segments)-1]] = value
+}
+
+// Lookup returns field from doc, following dotted names into nested objects
+// when the document is not flattened.
+func Lookup(doc map[string]any, field string) (any, bool) {
+	if value, ok := doc[field]; ok {
+		return value, true
+	}
+	head, rest, ok := strings.Cut(field, ".")
+	for ok {
+		if nested, isMap := doc[head].(map[string]any); isMap {
+			if value, found := Lookup(nested, rest); found {
+				return value, true
+			}
+		}
+		var next string
+		next, rest, ok = strings.Cut(rest, ".")
+		head += "." + next
+	}
+	return nil, false
+}
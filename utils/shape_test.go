@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestShapes(t *testing.T) {
+	raw, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: "u1"},
+		{Key: "stats", Value: bson.D{{Key: "country", Value: "US"}, {Key: "city", Value: "NYC"}}},
+		{Key: "meta", Value: bson.D{{Key: "source", Value: "web"}}},
+		{Key: "a.b", Value: "literal"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		shape string
+		want  map[string]any
+	}{
+		{"", map[string]any{
+			"_id": "u1", "location.country": "US", "stats.city": "NYC", "meta.source": "web", "a.b": "literal",
+		}},
+		{ShapeNested, map[string]any{
+			"_id":      "u1",
+			"location": map[string]any{"country": "US"},
+			"stats":    map[string]any{"city": "NYC"},
+			"meta":     map[string]any{"source": "web"},
+			"a":        map[string]any{"b": "literal"},
+		}},
+		{ShapeOriginal, map[string]any{
+			"_id":      "u1",
+			"location": map[string]any{"country": "US"},
+			"stats":    map[string]any{"city": "NYC"},
+			"meta":     map[string]any{"source": "web"},
+			"a.b":      "literal",
+		}},
+	}
+	for _, c := range cases {
+		m, err := newMapper(&Mappings{
+			MongoMappings: map[string]map[string]any{"users": {"_id": "id"}},
+			ElasticMappings: map[string]map[string]any{
+				"user_index": {"id": "_id", "stats.country": "location.country"},
+			},
+			Indices: map[string]IndexOptions{"user_index": {Mode: ModePassthrough, Shape: c.shape}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		processed, err := m.ProcessedMapper("users", []bson.Raw{raw})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := m.EsMapper("user_index", processed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got[0], c.want) {
+			t.Errorf("shape %q:\n got %v\nwant %v", c.shape, got[0], c.want)
+		}
+	}
+
+	if _, err := newMapper(&Mappings{Indices: map[string]IndexOptions{"user_index": {Shape: "tree"}}}); err == nil {
+		t.Error("expected error for unknown shape")
+	}
+}
+
+func TestShapeConflicts(t *testing.T) {
+	got := shapeDoc(map[string]any{"a": 1, "a.b": 2, "c.d": 3}, ShapeNested, nil)
+	want := map[string]any{"a": 1, "a.b": 2, "c": map[string]any{"d": 3}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	doc := map[string]any{
+		"flat.key": 1,
+		"user":     map[string]any{"address": map[string]any{"city": "NYC"}, "a.b": 2},
+	}
+	for field, want := range map[string]any{"flat.key": 1, "user.address.city": "NYC", "user.a.b": 2} {
+		if got, ok := Lookup(doc, field); !ok || got != want {
+			t.Errorf("%s: got %v, %v", field, got, ok)
+		}
+	}
+	if _, ok := Lookup(doc, "user.missing"); ok {
+		t.Error("expected missing field")
+	}
+}
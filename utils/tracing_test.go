@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMapContextSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(prev)
+
+	m, err := newMapper(&Mappings{MongoMappings: map[string]map[string]any{"users": {"name": "full_name"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := bson.Marshal(bson.D{{Key: "name", Value: "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, batch := provider.Tracer("test").Start(context.Background(), "sync.batch")
+	if _, err := m.MapContext(ctx, "users", "user_index", []bson.Raw{raw}); err != nil {
+		t.Fatal(err)
+	}
+	batch.End()
+
+	names := []string{}
+	for _, span := range recorder.Ended() {
+		if span.Name() == "sync.batch" {
+			continue
+		}
+		names = append(names, span.Name())
+		if span.Parent().SpanID() != batch.SpanContext().SpanID() {
+			t.Errorf("%s is not a child of the batch span", span.Name())
+		}
+	}
+	want := []string{"mapper.processed", "mapper.elastic", "mapper.transform"}
+	if len(names) != len(want) {
+		t.Fatalf("got spans %v want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("got spans %v want %v", names, want)
+		}
+	}
+}
@@ -0,0 +1,458 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-viper/mapstructure/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Field is the value a rule is working on while its steps run.
+type Field struct {
+	Name    string
+	Value   any
+	Present bool
+	Dropped bool
+}
+
+// Step is a single transformation of a field. doc is the flattened source
+// document and must not be modified.
+type Step interface {
+	Apply(field *Field, doc map[string]any) error
+}
+
+type StepConf struct {
+	Op          string   `mapstructure:"op"`
+	To          string   `mapstructure:"to"`
+	Type        string   `mapstructure:"type"`
+	Layout      string   `mapstructure:"layout"`
+	Style       string   `mapstructure:"style"`
+	Fields      []string `mapstructure:"fields"`
+	Separator   *string  `mapstructure:"separator"`
+	Value       any      `mapstructure:"value"`
+	Pattern     string   `mapstructure:"pattern"`
+	Replacement string   `mapstructure:"replacement"`
+	KeyEnv      string   `mapstructure:"key_env"`
+	KeyFile     string   `mapstructure:"key_file"`
+	KeepStart   int      `mapstructure:"keep_start"`
+	KeepEnd     *int     `mapstructure:"keep_end"`
+	Char        string   `mapstructure:"char"`
+}
+
+type rule struct {
+	source string
+	steps  []Step
+}
+
+func (r rule) apply(doc map[string]any) (Field, error) {
+	value, ok := doc[r.source]
+	field := Field{Name: r.source, Value: value, Present: ok}
+	for _, step := range r.steps {
+		if field.Dropped {
+			break
+		}
+		if err := step.Apply(&field, doc); err != nil {
+			return field, fmt.Errorf("%s: %w", r.source, err)
+		}
+	}
+	return field, nil
+}
+
+// compileRules turns a mappings section into rules sorted by source field.
+// Values are either a target name, a list of steps or nested rules whose keys
+// are joined with dots.
+func compileRules(section map[string]any) ([]rule, error) {
+	rules := []rule{}
+	if err := collectRules("", section, &rules); err != nil {
+		return nil, err
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].source < rules[j].source })
+	if err := checkExposed(rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func collectRules(prefix string, section map[string]any, rules *[]rule) error {
+	for key, value := range section {
+		source := key
+		if prefix != "" {
+			source = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case string:
+			*rules = append(*rules, rule{source: source, steps: []Step{renameStep{to: v}}})
+		case []any:
+			steps, err := compileSteps(v)
+			if err != nil {
+				return fmt.Errorf("invalid steps for %s: %w", source, err)
+			}
+			*rules = append(*rules, rule{source: source, steps: steps})
+		case map[string]any:
+			if err := collectRules(source, v, rules); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("invalid mapping for %s: %v", source, value)
+		}
+	}
+	return nil
+}
+
+func compileSteps(raw []any) ([]Step, error) {
+	steps := make([]Step, 0, len(raw))
+	for i, item := range raw {
+		var conf StepConf
+		if err := mapstructure.Decode(item, &conf); err != nil {
+			return nil, fmt.Errorf("step %d: %w", i, err)
+		}
+		step, err := NewStep(conf)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", i, err)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func NewStep(conf StepConf) (Step, error) {
+	separator := func(def string) string {
+		if conf.Separator != nil {
+			return *conf.Separator
+		}
+		return def
+	}
+	switch conf.Op {
+	case "rename":
+		if conf.To == "" {
+			return nil, fmt.Errorf("rename needs to")
+		}
+		return renameStep{to: conf.To}, nil
+	case "drop":
+		return dropStep{}, nil
+	case "cast":
+		switch conf.Type {
+		case "string", "int", "float", "bool", "date":
+		default:
+			return nil, fmt.Errorf("unknown cast type %q", conf.Type)
+		}
+		layout := conf.Layout
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		return castStep{typ: conf.Type, layout: layout}, nil
+	case "format":
+		switch conf.Style {
+		case "lower", "upper", "trim", "title":
+		case "":
+			if conf.Layout == "" {
+				return nil, fmt.Errorf("format needs a style or layout")
+			}
+		default:
+			return nil, fmt.Errorf("unknown format style %q", conf.Style)
+		}
+		return formatStep{style: conf.Style, layout: conf.Layout}, nil
+	case "concat":
+		if len(conf.Fields) == 0 {
+			return nil, fmt.Errorf("concat needs fields")
+		}
+		return concatStep{fields: conf.Fields, separator: separator(" ")}, nil
+	case "split":
+		return splitStep{separator: separator(",")}, nil
+	case "default":
+		return defaultStep{value: conf.Value}, nil
+	case "regex_replace":
+		re, err := regexp.Compile(conf.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+		return regexStep{re: re, replacement: conf.Replacement}, nil
+	case "hmac", "tokenize":
+		key, err := piiKey(conf)
+		if err != nil {
+			return nil, err
+		}
+		if conf.Op == "hmac" {
+			return hmacStep{key: key}, nil
+		}
+		return tokenizeStep{key: key}, nil
+	case "mask":
+		keepEnd := 4
+		if conf.KeepEnd != nil {
+			keepEnd = *conf.KeepEnd
+		}
+		if conf.KeepStart < 0 || keepEnd < 0 {
+			return nil, fmt.Errorf("mask keeps a negative number of characters")
+		}
+		char := '*'
+		if conf.Char != "" {
+			runes := []rune(conf.Char)
+			if len(runes) != 1 {
+				return nil, fmt.Errorf("mask char must be a single character")
+			}
+			char = runes[0]
+		}
+		return maskStep{keepStart: conf.KeepStart, keepEnd: keepEnd, char: char}, nil
+	case "redact":
+		value := conf.Value
+		if value == nil {
+			value = redacted
+		}
+		return redactStep{value: value}, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", conf.Op)
+}
+
+type renameStep struct {
+	to string
+}
+
+func (s renameStep) Apply(field *Field, _ map[string]any) error {
+	field.Name = s.to
+	return nil
+}
+
+type dropStep struct{}
+
+func (dropStep) Apply(field *Field, _ map[string]any) error {
+	field.Dropped = true
+	return nil
+}
+
+type castStep struct {
+	typ    string
+	layout string
+}
+
+func (s castStep) Apply(field *Field, _ map[string]any) error {
+	if !field.Present || field.Value == nil {
+		return nil
+	}
+	value, err := castValue(field.Value, s.typ, s.layout)
+	if err != nil {
+		return err
+	}
+	field.Value = value
+	return nil
+}
+
+func castValue(value any, typ, layout string) (any, error) {
+	switch typ {
+	case "string":
+		if t, ok := value.(primitive.DateTime); ok {
+			return t.Time().UTC().Format(layout), nil
+		}
+		if t, ok := value.(time.Time); ok {
+			return t.UTC().Format(layout), nil
+		}
+		if oid, ok := value.(primitive.ObjectID); ok {
+			return oid.Hex(), nil
+		}
+		return fmt.Sprint(value), nil
+	case "int":
+		switch v := value.(type) {
+		case int32:
+			return int64(v), nil
+		case int64:
+			return v, nil
+		case int:
+			return int64(v), nil
+		case float64:
+			return int64(math.Trunc(v)), nil
+		case bool:
+			if v {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		case string:
+			n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot cast %q to int", v)
+			}
+			return n, nil
+		}
+	case "float":
+		switch v := value.(type) {
+		case int32:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		case int:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case primitive.Decimal128:
+			f, err := strconv.ParseFloat(v.String(), 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot cast %s to float", v.String())
+			}
+			return f, nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot cast %q to float", v)
+			}
+			return f, nil
+		}
+	case "bool":
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case int32:
+			return v != 0, nil
+		case int64:
+			return v != 0, nil
+		case int:
+			return v != 0, nil
+		case float64:
+			return v != 0, nil
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("cannot cast %q to bool", v)
+			}
+			return b, nil
+		}
+	case "date":
+		switch v := value.(type) {
+		case primitive.DateTime:
+			return v, nil
+		case time.Time:
+			return primitive.NewDateTimeFromTime(v), nil
+		case int64:
+			return primitive.DateTime(v), nil
+		case int32:
+			return primitive.DateTime(int64(v)), nil
+		case float64:
+			return primitive.DateTime(int64(v)), nil
+		case string:
+			t, err := time.Parse(layout, strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("cannot cast %q to date with layout %q", v, layout)
+			}
+			return primitive.NewDateTimeFromTime(t), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot cast %T to %s", value, typ)
+}
+
+type formatStep struct {
+	style  string
+	layout string
+}
+
+func (s formatStep) Apply(field *Field, _ map[string]any) error {
+	if !field.Present || field.Value == nil {
+		return nil
+	}
+	switch v := field.Value.(type) {
+	case primitive.DateTime:
+		if s.layout != "" {
+			field.Value = v.Time().UTC().Format(s.layout)
+		}
+		return nil
+	case time.Time:
+		if s.layout != "" {
+			field.Value = v.UTC().Format(s.layout)
+		}
+		return nil
+	case string:
+		switch s.style {
+		case "lower":
+			field.Value = strings.ToLower(v)
+		case "upper":
+			field.Value = strings.ToUpper(v)
+		case "trim":
+			field.Value = strings.TrimSpace(v)
+		case "title":
+			field.Value = titleCase(v)
+		}
+	}
+	return nil
+}
+
+func titleCase(s string) string {
+	prev := ' '
+	return strings.Map(func(r rune) rune {
+		defer func() { prev = r }()
+		if unicode.IsSpace(prev) {
+			return unicode.ToUpper(r)
+		}
+		return unicode.ToLower(r)
+	}, s)
+}
+
+type concatStep struct {
+	fields    []string
+	separator string
+}
+
+func (s concatStep) Apply(field *Field, doc map[string]any) error {
+	parts := make([]string, 0, len(s.fields))
+	for _, name := range s.fields {
+		value, ok := doc[name]
+		if name == field.Name && field.Present {
+			value, ok = field.Value, true
+		}
+		if !ok || value == nil {
+			continue
+		}
+		parts = append(parts, fmt.Sprint(value))
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	field.Value = strings.Join(parts, s.separator)
+	field.Present = true
+	return nil
+}
+
+type splitStep struct {
+	separator string
+}
+
+func (s splitStep) Apply(field *Field, _ map[string]any) error {
+	str, ok := field.Value.(string)
+	if !field.Present || !ok {
+		return nil
+	}
+	parts := []any{}
+	for _, part := range strings.Split(str, s.separator) {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	field.Value = parts
+	return nil
+}
+
+type defaultStep struct {
+	value any
+}
+
+func (s defaultStep) Apply(field *Field, _ map[string]any) error {
+	if !field.Present || field.Value == nil {
+		field.Value = s.value
+		field.Present = true
+	}
+	return nil
+}
+
+type regexStep struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+func (s regexStep) Apply(field *Field, _ map[string]any) error {
+	if str, ok := field.Value.(string); ok && field.Present {
+		field.Value = s.re.ReplaceAllString(str, s.replacement)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func applyStep(t *testing.T, conf StepConf, field Field, doc map[string]any) Field {
+	t.Helper()
+	step, err := NewStep(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := step.Apply(&field, doc); err != nil {
+		t.Fatal(err)
+	}
+	return field
+}
+
+func TestSteps(t *testing.T) {
+	sep := "|"
+	date := time.Date(2025, 8, 21, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name  string
+		conf  StepConf
+		field Field
+		doc   map[string]any
+		want  Field
+	}{
+		{"rename", StepConf{Op: "rename", To: "b"}, Field{Name: "a", Value: 1, Present: true}, nil,
+			Field{Name: "b", Value: 1, Present: true}},
+		{"drop", StepConf{Op: "drop"}, Field{Name: "a", Value: 1, Present: true}, nil,
+			Field{Name: "a", Value: 1, Present: true, Dropped: true}},
+		{"cast int", StepConf{Op: "cast", Type: "int"}, Field{Name: "a", Value: " 42", Present: true}, nil,
+			Field{Name: "a", Value: int64(42), Present: true}},
+		{"cast float", StepConf{Op: "cast", Type: "float"}, Field{Name: "a", Value: int32(2), Present: true}, nil,
+			Field{Name: "a", Value: 2.0, Present: true}},
+		{"cast bool", StepConf{Op: "cast", Type: "bool"}, Field{Name: "a", Value: "true", Present: true}, nil,
+			Field{Name: "a", Value: true, Present: true}},
+		{"cast date", StepConf{Op: "cast", Type: "date", Layout: "2006-01-02"}, Field{Name: "a", Value: "2025-08-21", Present: true}, nil,
+			Field{Name: "a", Value: primitive.NewDateTimeFromTime(date), Present: true}},
+		{"cast string", StepConf{Op: "cast", Type: "string"}, Field{Name: "a", Value: int32(7), Present: true}, nil,
+			Field{Name: "a", Value: "7", Present: true}},
+		{"format lower", StepConf{Op: "format", Style: "lower"}, Field{Name: "email", Value: "A@B.COM", Present: true}, nil,
+			Field{Name: "email", Value: "a@b.com", Present: true}},
+		{"format title", StepConf{Op: "format", Style: "title"}, Field{Name: "a", Value: "jOHN doe", Present: true}, nil,
+			Field{Name: "a", Value: "John Doe", Present: true}},
+		{"format date layout", StepConf{Op: "format", Layout: "02/01/2006"}, Field{Name: "a", Value: primitive.NewDateTimeFromTime(date), Present: true}, nil,
+			Field{Name: "a", Value: "21/08/2025", Present: true}},
+		{"concat", StepConf{Op: "concat", Fields: []string{"first", "last"}}, Field{Name: "full"}, map[string]any{"first": "John", "last": "Doe"},
+			Field{Name: "full", Value: "John Doe", Present: true}},
+		{"concat separator", StepConf{Op: "concat", Fields: []string{"a", "missing", "b"}, Separator: &sep}, Field{Name: "a", Value: "x", Present: true}, map[string]any{"a": "old", "b": "y"},
+			Field{Name: "a", Value: "x|y", Present: true}},
+		{"split", StepConf{Op: "split"}, Field{Name: "tags", Value: "a, b,,c", Present: true}, nil,
+			Field{Name: "tags", Value: []any{"a", "b", "c"}, Present: true}},
+		{"default missing", StepConf{Op: "default", Value: "unknown"}, Field{Name: "a"}, nil,
+			Field{Name: "a", Value: "unknown", Present: true}},
+		{"default present", StepConf{Op: "default", Value: "unknown"}, Field{Name: "a", Value: "x", Present: true}, nil,
+			Field{Name: "a", Value: "x", Present: true}},
+		{"regex replace", StepConf{Op: "regex_replace", Pattern: `[^0-9]`}, Field{Name: "phone", Value: "+1 (555) 010", Present: true}, nil,
+			Field{Name: "phone", Value: "1555010", Present: true}},
+		{"missing field untouched", StepConf{Op: "format", Style: "upper"}, Field{Name: "a"}, nil,
+			Field{Name: "a"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := applyStep(t, c.conf, c.field, c.doc)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %#v want %#v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestStepErrors(t *testing.T) {
+	invalid := []StepConf{
+		{Op: "explode"},
+		{Op: "rename"},
+		{Op: "cast", Type: "uuid"},
+		{Op: "format"},
+		{Op: "concat"},
+		{Op: "regex_replace", Pattern: "("},
+	}
+	for _, conf := range invalid {
+		if _, err := NewStep(conf); err == nil {
+			t.Errorf("expected error for %+v", conf)
+		}
+	}
+	step, _ := NewStep(StepConf{Op: "cast", Type: "int"})
+	if err := step.Apply(&Field{Name: "a", Value: "abc", Present: true}, nil); err == nil {
+		t.Error("expected cast error")
+	}
+}
+
+func TestMapperRules(t *testing.T) {
+	m, err := newMapper(&Mappings{
+		MongoMappings: map[string]map[string]any{
+			"users": {
+				"_id":   "id",
+				"stats": map[string]any{"country": "user_country"},
+				"email": []any{
+					map[string]any{"op": "format", "style": "lower"},
+					map[string]any{"op": "rename", "to": "user_email"},
+				},
+				"password": []any{map[string]any{"op": "drop"}},
+				"full_name": []any{
+					map[string]any{"op": "concat", "fields": []any{"name", "last_name"}},
+				},
+			},
+		},
+		ElasticMappings: map[string]map[string]any{
+			"user_index": {
+				"id":           "_id",
+				"user_email":   "email",
+				"user_country": "country",
+				"full_name":    "full_name",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: "u1"},
+		{Key: "name", Value: "Alice"},
+		{Key: "last_name", Value: "Smith"},
+		{Key: "email", Value: "Alice@Example.COM"},
+		{Key: "password", Value: "secret"},
+		{Key: "stats", Value: bson.D{{Key: "country", Value: "US"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped, err := m.ProcessedMapper("users", []bson.Raw{raw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"id":           "u1",
+		"name":         "Alice",
+		"last_name":    "Smith",
+		"user_email":   "alice@example.com",
+		"user_country": "US",
+		"full_name":    "Alice Smith",
+	}
+	if !reflect.DeepEqual(mapped[0], want) {
+		t.Fatalf("mongo mapping\n got:  %#v\n want: %#v", mapped[0], want)
+	}
+
+	esDocs, err := m.EsMapper("user_index", mapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantEs := map[string]any{
+		"_id":       "u1",
+		"email":     "alice@example.com",
+		"country":   "US",
+		"full_name": "Alice Smith",
+	}
+	if !reflect.DeepEqual(esDocs[0], wantEs) {
+		t.Fatalf("elastic mapping\n got:  %#v\n want: %#v", esDocs[0], wantEs)
+	}
+
+	if _, err := newMapper(&Mappings{MongoMappings: map[string]map[string]any{
+		"users": {"email": []any{map[string]any{"op": "explode"}}},
+	}}); err == nil {
+		t.Fatal("expected invalid step to fail at startup")
+	}
+}
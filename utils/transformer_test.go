@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"mongo-es/transform"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMapperTransformers(t *testing.T) {
+	transform.Register("utils_test_tag", transform.Func(func(meta transform.Meta, doc map[string]any) ([]map[string]any, error) {
+		if doc["skip"] == true {
+			return nil, nil
+		}
+		doc["source"] = meta.Collection + "/" + meta.Index
+		return []map[string]any{doc}, nil
+	}))
+	opts := map[string]IndexOptions{"user_index": {Mode: ModePassthrough, Transformers: []string{"utils_test_tag"}}}
+	m, err := newMapper(&Mappings{Indices: opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raws := []bson.Raw{}
+	for _, skip := range []bool{false, true} {
+		raw, err := bson.Marshal(bson.D{{Key: "skip", Value: skip}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		raws = append(raws, raw)
+	}
+	docs, err := m.Map("users", "user_index", raws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0]["source"] != "users/user_index" {
+		t.Errorf("unexpected docs %v", docs)
+	}
+	if _, ok := m.RawPlan("users", "user_index"); ok {
+		t.Error("expected no raw plan with transformers")
+	}
+
+	opts["user_index"] = IndexOptions{Transformers: []string{"missing"}}
+	if _, err := newMapper(&Mappings{Indices: opts}); err == nil {
+		t.Error("expected error for unknown transformer")
+	}
+}